@@ -0,0 +1,257 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// agentKey tells the sessions apart: the reason changes the session identity
+// and the clients may store their sessions in different credentials files.
+type agentKey struct {
+	name            string
+	reason          string
+	credentialsPath string
+}
+
+type agentEntry struct {
+	parameters       pkg.SwitchRoleParameters
+	credential       *internal.Credential
+	storeCredentials bool
+}
+
+// agent keeps the sessions it handed out fresh. Everything it does is
+// serialised, the switch code it relies on is not safe for concurrent use.
+type agent struct {
+	mu       sync.Mutex
+	sessions map[agentKey]*agentEntry
+}
+
+// runningAgent is set in the agent, which keeps the MFA sessions itself
+// instead of asking an agent for them.
+var runningAgent bool
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Keep the sessions of roles fresh in the background.",
+	Long: `Serve the sessions of roles on a unix socket to the other roller commands and assume
+the roles again shortly before their sessions expire, using the cached MFA session of the
+source profile. Only processes of the same user can connect.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if internal.VaultBackend() {
+			// ask for the passphrase while there is a terminal
+			internal.ReadSessions()
+		}
+
+		listener, err := internal.ListenAgent()
+		internal.ExitOnError(err)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			// removes the socket
+			listener.Close()
+			os.Exit(0)
+		}()
+
+		internal.Interactive = false
+		runningAgent = true
+		// storing the refreshed sessions was confirmed by the clients
+		viper.Set("confirm", false)
+		keepRunningOnFailure()
+		// the reason comes from the clients
+		viper.Set("reason", "")
+
+		a := &agent{sessions: make(map[agentKey]*agentEntry)}
+		go a.refresh()
+
+		fmt.Fprintf(os.Stderr, "Listening on %s\n", internal.AgentSocketPath())
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				internal.Warn("%s", err)
+				continue
+			}
+			go a.serve(conn)
+		}
+	},
+}
+
+func (a *agent) serve(conn *net.UnixConn) {
+	defer conn.Close()
+	if err := internal.CheckPeer(conn); err != nil {
+		internal.Warn("%s", err)
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	var request internal.AgentRequest
+	if err := json.NewDecoder(conn).Decode(&request); err == io.EOF {
+		// checking whether the agent runs
+		return
+	} else if err != nil {
+		internal.Warn("invalid request: %s", err)
+		return
+	}
+
+	var response internal.AgentResponse
+	credential, err := a.credential(request)
+	if err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Credential = credential
+	}
+	json.NewEncoder(conn).Encode(response)
+}
+
+func (a *agent) credential(request internal.AgentRequest) (*internal.Credential, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if request.MFA {
+		return a.mfaSession(request)
+	}
+
+	key := agentKey{request.Name, request.Reason, request.CredentialsPath}
+	if key.credentialsPath == "" {
+		key.credentialsPath = internal.CredentialsPath()
+	}
+
+	s, ok := a.sessions[key]
+	if ok && reflect.DeepEqual(s.parameters, request.Parameters) &&
+		s.credential.Expiration.After(time.Now().Add(viper.GetDuration("agent_refresh_before"))) {
+		s.storeCredentials = s.storeCredentials || request.StoreCredentials
+		return s.credential, nil
+	}
+
+	s = &agentEntry{parameters: request.Parameters, storeCredentials: request.StoreCredentials}
+	// the client stores the session itself
+	if err := a.assume(key, s); err != nil {
+		return nil, err
+	}
+	a.sessions[key] = s
+
+	return s.credential, nil
+}
+
+// mfaSession returns the MFA session of the source profile the agent keeps,
+// or keeps the one handed to it by a client.
+func (a *agent) mfaSession(request internal.AgentRequest) (*internal.Credential, error) {
+	sessions := internal.ReadMFASessions()
+	if request.Credential != nil {
+		sessions.Add(request.Name, request.Credential)
+		sessions.Save()
+		return request.Credential, nil
+	}
+
+	c, ok := sessions.Credentials[request.Name]
+	if !ok || c.Expiration.Before(time.Now()) {
+		return nil, fmt.Errorf("the agent has no MFA session of %s", request.Name)
+	}
+
+	return c, nil
+}
+
+// assume assumes the role of the session again.
+func (a *agent) assume(key agentKey, s *agentEntry) (err error) {
+	defer catchFailure(&err)
+
+	// the source profile may differ from the last request
+	awsSession = nil
+	reason = key.reason
+	s.credential = assumeRole(key.name, s.parameters)
+	fmt.Fprintf(os.Stderr, "Assumed %s until %s\n", key.name, s.credential.Expiration.Local().Format(time.RFC3339))
+
+	return nil
+}
+
+// refresh assumes the roles again before their sessions expire, and stores
+// them in the credentials files of the clients which asked for it. The files
+// are written without holding a.mu, so the clients are not kept waiting
+// while the agent waits for the locks of the files.
+func (a *agent) refresh() {
+	for range time.Tick(time.Minute) {
+		for key, credential := range a.refreshSessions() {
+			if err := storeAgentSession(key, credential); err != nil {
+				internal.Warn("could not store the session of %s in %s: %s", key.name, key.credentialsPath, err)
+			}
+		}
+	}
+}
+
+// refreshSessions assumes the roles again whose sessions expire soon and
+// returns the ones to store.
+func (a *agent) refreshSessions() map[agentKey]*internal.Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	store := make(map[agentKey]*internal.Credential)
+	limit := time.Now().Add(viper.GetDuration("agent_refresh_before"))
+	for key, s := range a.sessions {
+		if s.credential.Expiration.After(limit) {
+			continue
+		}
+		if err := a.assume(key, s); err != nil {
+			internal.Warn("could not refresh %s: %s", key.name, err)
+			if s.credential.Expiration.Before(time.Now()) {
+				delete(a.sessions, key)
+			}
+			continue
+		}
+		if s.storeCredentials {
+			store[key] = s.credential
+		}
+	}
+
+	return store
+}
+
+// storeAgentSession writes the session to the credentials file of the client.
+func storeAgentSession(key agentKey, credential *internal.Credential) (err error) {
+	defer catchFailure(&err)
+
+	credentials := internal.ReadCredentialsFile(key.credentialsPath)
+	credentials.Add(key.name, credential)
+	credentials.Save()
+
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(agentCmd)
+	viper.SetDefault("agent_refresh_before", "10m")
+}
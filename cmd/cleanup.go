@@ -21,54 +21,201 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
 	"github.com/mitom/roller/internal"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	"time"
 )
 
 var includeNamed bool
+var cleanupStale bool
 
 var cleanupCmd = &cobra.Command{
 	Use:   "cleanup",
 	Short: "Clean up the aws configuration files.",
 	Long: `Removes all credentials which were created 
     by Roller and expired for over an hour. By default,
-    it will leave named profiles.`,
+    it will leave named profiles. The expired sessions
+    kept by roller itself, in the vault too, and the
+    expired MFA sessions are removed as well, as are
+    the sessions an older roller stored in plaintext.
+
+    With --stale, the profiles set up by roller whose
+    account and role are not loaded any more are removed
+    too, named ones included. The changes are shown and
+    have to be confirmed before they are written,
+    unless --yes is given.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		profiles = internal.ReadProfiles()
-		credentials = internal.ReadCredentials()
-		limit := time.Now()
-		limit.Add(-60 * 60 * 1000 * 1000) // 1 hour in nanoseconds
-
-		dirty := false
-		for name, v := range credentials.Credentials {
-			profile, ok := profiles.Profiles[name]
-
-			// if it doesn't have a profile or not roller managed
-			// or not expired for over an hour yet, ignore it.
-			if !ok ||
-				!profile.Roller ||
-				!v.Expiration.Before(limit) ||
-				(!includeNamed && name != profile.GenerateName()) {
-				continue
-			}
+		if cleanupStale {
+			// the removal of stale profiles is always confirmed
+			viper.Set("confirm", true)
+		}
+
+		cleanup()
+	},
+}
+
+func cleanup() {
+	profiles = internal.ReadProfiles()
+	credentials = internal.ReadCredentials()
+	limit := time.Now()
+	limit.Add(-60 * 60 * 1000 * 1000) // 1 hour in nanoseconds
+
+	// with the vault the sessions of the profiles are kept there instead
+	expirations := make(map[string]time.Time)
+	var sessions *internal.Credentials
+	if internal.VaultBackend() {
+		sessions = internal.ReadSessions()
+		for name, v := range sessions.Credentials {
+			expirations[name] = v.Expiration
+		}
+	}
+	for name, v := range credentials.Credentials {
+		expirations[name] = v.Expiration
+	}
 
+	dirty := false
+	for name, expiration := range expirations {
+		profile, ok := profiles.Profiles[name]
+
+		// if it doesn't have a profile or not roller managed
+		// or not expired for over an hour yet, ignore it.
+		if !ok ||
+			!profile.Roller ||
+			!expiration.Before(limit) ||
+			(!includeNamed && name != profile.GenerateName()) {
+			continue
+		}
+
+		if _, ok := credentials.Credentials[name]; ok {
 			credentials.Delete(name)
-			profiles.Delete(name)
+		}
+		profiles.Delete(name)
+
+		dirty = true
+	}
+
+	var stale []string
+	if cleanupStale {
+		stale = removeStale()
+		dirty = dirty || len(stale) > 0
+	}
+
+	if dirty {
+		internal.SaveAll(profiles, credentials)
+	}
+	if !internal.DryRun() {
+		for _, name := range stale {
+			fmt.Printf("Removed %s\n", name)
+		}
+	}
 
+	// they were stored in plaintext before they were only kept in memory
+	if !internal.VaultBackend() {
+		removeLeftover(internal.SessionsPath())
+	}
+	if internal.MFASessionsInMemory() {
+		removeLeftover(internal.MFASessionsPath())
+	}
+
+	if internal.DryRun() {
+		return
+	}
+
+	// the sessions kept by roller itself
+	if sessions == nil {
+		sessions = internal.ReadSessions()
+	}
+	purgeExpired(sessions, limit)
+	purgeExpired(internal.ReadMFASessions(), limit)
+}
+
+// removeLeftover removes a file of sessions an older roller stored in
+// plaintext, which are not read any more.
+func removeLeftover(path string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if internal.DryRun() {
+		fmt.Printf("Would remove %s, the sessions in it are not used any more\n", path)
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		internal.Warn("could not remove %s: %s", path, err)
+		return
+	}
+	fmt.Printf("Removed %s, the sessions in it are not used any more\n", path)
+}
+
+// purgeExpired removes the sessions which expired before limit from store.
+func purgeExpired(store *internal.Credentials, limit time.Time) {
+	dirty := false
+	for name, v := range store.Credentials {
+		if v.Expiration.Before(limit) {
+			store.Delete(name)
 			dirty = true
 		}
+	}
+	if dirty {
+		store.Save()
+	}
+}
+
+// removeStale removes the profiles set up by roller whose account and role
+// are not loaded any more, along with their credentials, and returns their
+// names. They are only listed here, as the removal is yet to be confirmed.
+func removeStale() []string {
+	if len(internal.FailedLoaders) > 0 {
+		// their roles may be missing, not stale
+		internal.Warn("not looking for stale profiles, the loaders failed: %s", strings.Join(internal.FailedLoaders, ", "))
+		return nil
+	}
+	if len(internal.AccountCache) == 0 {
+		internal.Warn("no roles are loaded, not looking for stale profiles")
+		return nil
+	}
+
+	loaded := make(map[string]bool)
+	for _, p := range internal.AccountCache {
+		loaded[internal.Profile{Account: p.Parameters.AccountID, Role: p.Parameters.Role}.GenerateName()] = true
+	}
+
+	names := make([]string, 0, len(profiles.Profiles))
+	for name := range profiles.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var removed []string
+	for _, name := range names {
+		profile := profiles.Profiles[name]
+		_, ok := internal.AccountCache[name]
+		// named profiles are kept while their role is loaded under any name
+		if !profile.Roller || ok || loaded[profile.GenerateName()] {
+			continue
+		}
 
-		if dirty {
-			profiles.Save()
-			credentials.Save()
+		fmt.Printf("Would remove %s, %s is not loaded\n", name, profile.GenerateName())
+		profiles.Delete(name)
+		if _, ok := credentials.Credentials[name]; ok {
+			credentials.Delete(name)
 		}
-	},
+		removed = append(removed, name)
+	}
+
+	return removed
 }
 
 func init() {
 	RootCmd.AddCommand(cleanupCmd)
 	cleanupCmd.Flags().BoolVar(&includeNamed, "include-named", false, "Include named profiles.")
+	cleanupCmd.Flags().BoolVar(&cleanupStale, "stale", false, "Remove the profiles whose role is not loaded any more.")
 }
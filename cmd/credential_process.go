@@ -0,0 +1,78 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mitom/roller/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// processCredentials is the output format expected from a credential_process.
+type processCredentials struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string
+}
+
+var credentialProcessCmd = &cobra.Command{
+	Use:   "credential-process <role>",
+	Short: "Print the credentials of a role for the credential_process setting of AWS profiles.",
+	Long: `Print the credentials of a role in the format the AWS SDKs expect from a credential_process.
+The session is never written to the AWS credentials file. It is reused while it is valid when it is
+kept in the vault or by the agent, otherwise the role is assumed again on every call.
+Use 'roller switch --credential-process' to set up profiles using it.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+			return err
+		}
+		if _, _, exists := roleParameters(args[0]); !exists {
+			return fmt.Errorf("The given role can not be loaded from the cache: %s", args[0])
+		}
+
+		return nil
+	},
+	ValidArgsFunction: completeRoles,
+	Run: func(cmd *cobra.Command, args []string) {
+		parameters, _, _ := roleParameters(args[0])
+		credential := roleSession(args[0], parameters)
+
+		err := json.NewEncoder(os.Stdout).Encode(processCredentials{
+			Version:         1,
+			AccessKeyId:     credential.AccessKey,
+			SecretAccessKey: credential.SecretKey,
+			SessionToken:    credential.Token,
+			Expiration:      credential.Expiration.UTC().Format(time.RFC3339),
+		})
+		internal.ExitOnError(err)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(credentialProcessCmd)
+}
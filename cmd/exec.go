@@ -0,0 +1,263 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec [role] -- <command> [args...]",
+	Short: "Run a command with the credentials of an AWS role.",
+	Long: `Run a command with the credentials of a role in its environment, without writing
+them to the AWS configuration files. While the agent runs, the command gets the sessions it
+keeps fresh from an endpoint like the ECS container credentials one, for as long as it runs.
+Otherwise a session of the role valid for at least 15 more minutes is reused if there is one,
+or the role is assumed. The exit code of the command is propagated.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash < 0 || dash == len(args) {
+			return fmt.Errorf("the command to run has to be given after --")
+		}
+		if dash > 1 {
+			return fmt.Errorf("only one role can be given before --")
+		}
+		if dash == 0 && (accountID == "" || role == "") {
+			return fmt.Errorf("either a role or --account and --role have to be given")
+		}
+		if dash == 1 {
+			if _, _, exists := roleParameters(args[0]); !exists {
+				return fmt.Errorf("The given role can not be loaded from the cache: %s", args[0])
+			}
+		}
+
+		return nil
+	},
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveDefault
+		}
+
+		return completeRoles(cmd, args, toComplete)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		dash := cmd.ArgsLenAtDash()
+		command := args[dash:]
+
+		var name string
+		var parameters pkg.SwitchRoleParameters
+		if dash == 1 {
+			var roleRegion string
+			name = args[0]
+			parameters, roleRegion, _ = roleParameters(name)
+			if region == "" {
+				region = roleRegion
+			}
+		} else {
+			parameters = pkg.SwitchRoleParameters{AccountID: accountID, Role: role, Via: viaHops()}
+			name = internal.Profile{Account: accountID, Role: role}.GenerateName()
+		}
+		if fromProfile != "" {
+			parameters.FromProfile = fromProfile
+		} else if parameters.FromProfile == "" {
+			parameters.FromProfile = viper.GetString("profile")
+		}
+		if ttl != "" {
+			parameters.TTL = ttl
+		}
+		if via != "" {
+			parameters.Via = viaHops()
+		}
+		switchRoleParameters = &parameters
+
+		var env []string
+		if applySessionOptions(cmd, &parameters) {
+			// a session with other options than the role's is not kept
+			assumed := switchTo(parameters)
+			env = staticCredentialEnv(&internal.Credential{
+				Expiration: *assumed.Expiration,
+				AccessKey:  *assumed.AccessKeyId,
+				SecretKey:  *assumed.SecretAccessKey,
+				Token:      *assumed.SessionToken,
+			})
+		} else if agentSession(name, parameters, false) != nil {
+			// the agent keeps the sessions fresh for as long as the command runs
+			env = serveExecSessions(name, parameters)
+		} else {
+			credential := cachedSession(name)
+			if credential == nil || credential.Expiration.Before(time.Now().Add(execMinLifetime)) {
+				credential = assumeRole(name, parameters)
+			}
+			env = staticCredentialEnv(credential)
+		}
+
+		os.Exit(runWithCredentials(command, credentialEnv(name, env)))
+	},
+}
+
+// execMinLifetime is how long a kept session has to be valid for at least to
+// be given to a command, as it can not be refreshed once the command runs.
+const execMinLifetime = 15 * time.Minute
+
+// credentialEnv returns the current environment with the credentials
+// variables set, and any profile selection or other credentials removed so
+// they do not take precedence.
+func credentialEnv(name string, credentials []string) []string {
+	env := make([]string, 0, len(os.Environ())+8)
+	for _, e := range os.Environ() {
+		key := strings.SplitN(e, "=", 2)[0]
+		switch key {
+		case "AWS_PROFILE", "AWS_DEFAULT_PROFILE", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY",
+			"AWS_SESSION_TOKEN", "AWS_SECURITY_TOKEN", "AWS_SESSION_EXPIRATION", "AWS_CREDENTIAL_EXPIRATION",
+			"AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+			"AWS_CONTAINER_AUTHORIZATION_TOKEN":
+			continue
+		}
+		if region != "" && (key == "AWS_REGION" || key == "AWS_DEFAULT_REGION") {
+			continue
+		}
+		env = append(env, e)
+	}
+
+	env = append(env, credentials...)
+	env = append(env, "ROLLER_ACTIVE_PROFILE="+name)
+	if region != "" {
+		env = append(env, "AWS_REGION="+region, "AWS_DEFAULT_REGION="+region)
+	}
+
+	return env
+}
+
+// staticCredentialEnv returns the variables with the keys of the session.
+func staticCredentialEnv(credential *internal.Credential) []string {
+	expiration := credential.Expiration.UTC().Format(time.RFC3339)
+
+	return []string{
+		"AWS_ACCESS_KEY_ID=" + credential.AccessKey,
+		"AWS_SECRET_ACCESS_KEY=" + credential.SecretKey,
+		"AWS_SESSION_TOKEN=" + credential.Token,
+		"AWS_SESSION_EXPIRATION=" + expiration,
+		"AWS_CREDENTIAL_EXPIRATION=" + expiration,
+	}
+}
+
+// serveExecSessions serves the sessions of the role the agent keeps fresh
+// to the command like the ECS container credentials endpoint, on a port and
+// with a token of its own, and returns the variables pointing the SDKs at it.
+func serveExecSessions(name string, parameters pkg.SwitchRoleParameters) []string {
+	token := randomToken()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	internal.ExitOnError(err)
+
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/credentials", containerCredentialsHandler(token, func(r *http.Request) (servedSession, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// only the agent is asked, the command may be using the terminal
+		session := servedSession{name: name, parameters: parameters}
+		if session.credential = agentSession(name, parameters, false); session.credential == nil {
+			return session, fmt.Errorf("the agent could not provide a session of %s", name)
+		}
+
+		return session, nil
+	}))
+	go http.Serve(listener, mux)
+
+	return []string{
+		fmt.Sprintf("AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s/credentials", listener.Addr()),
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN=" + token,
+	}
+}
+
+// runWithCredentials runs the command, forwarding the signals roller
+// receives to end it, and returns its exit code. Interrupts from the terminal
+// reach the command by themselves, as it is in the same process group, so
+// they are only kept from ending roller: a second one would force some tools,
+// like terraform, to stop uncleanly.
+func runWithCredentials(command []string, env []string) int {
+	child := exec.Command(command[0], command[1:]...)
+	child.Env = env
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	if err := child.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 127
+	}
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGTERM || sig == syscall.SIGHUP {
+				child.Process.Signal(sig)
+			}
+		}
+	}()
+
+	err := child.Wait()
+	if err == nil {
+		return 0
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+
+		return exitErr.ExitCode()
+	}
+
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+func init() {
+	execCmd.Flags().StringVarP(&fromProfile, "profile", "p", "", "The name of an existing profile to use to switch from. Defaults to 'default'.")
+	execCmd.Flags().StringVar(&region, "region", "", "The region to set for the command.")
+	execCmd.Flags().StringVar(&accountID, "account", "", "The account id to switch to.")
+	execCmd.Flags().StringVar(&role, "role", "", "The AWS role name to switch to.")
+	execCmd.Flags().StringVar(&ttl, "ttl", "", "The session duration to request when assuming the role.")
+	addSessionOptionFlags(execCmd)
+	execCmd.Flags().StringVar(&reason, "reason", "", "Why the role is assumed, e.g. a ticket number, for the session templates.")
+	execCmd.Flags().StringVar(&via, "via", "", "The roles to assume before the role, as <account id>/<role>[:<external id>] separated by '>'.")
+	RootCmd.AddCommand(execCmd)
+}
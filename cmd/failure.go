@@ -0,0 +1,50 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+
+	"github.com/mitom/roller/internal"
+)
+
+// commandFailure is what the long running commands turn the errors which
+// would end roller into, so they only fail the request at hand.
+type commandFailure string
+
+// keepRunningOnFailure makes the errors which would end roller panic, for
+// catchFailure to turn them into an error.
+func keepRunningOnFailure() {
+	internal.Fail = func(err string, code int) {
+		panic(commandFailure(err))
+	}
+}
+
+// catchFailure is deferred to return the failure as err.
+func catchFailure(err *error) {
+	if r := recover(); r != nil {
+		failure, ok := r.(commandFailure)
+		if !ok {
+			panic(r)
+		}
+		*err = errors.New(string(failure))
+	}
+}
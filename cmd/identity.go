@@ -0,0 +1,107 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitom/roller/internal"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// principal types of the source identity
+const (
+	principalUser          = "user"
+	principalAssumedRole   = "assumed-role"
+	principalFederatedUser = "federated-user"
+	principalRoot          = "root"
+)
+
+// identity is the principal the source profile authenticates as.
+type identity struct {
+	Arn       string
+	Partition string
+	AccountID string
+	Type      string
+	// Name is the user name, the session name of an assumed role or the
+	// name of a federated user.
+	Name string
+}
+
+// UserMFASerial returns the serial of the virtual MFA device named after
+// an IAM user, the way it was always assumed before mfa_serial was supported.
+func (i identity) UserMFASerial() string {
+	if i.Type != principalUser {
+		return ""
+	}
+
+	return fmt.Sprintf("arn:%s:iam::%s:mfa/%s", i.Partition, i.AccountID, i.Name)
+}
+
+// parseIdentity reads the identity from the ARN returned by GetCallerIdentity.
+func parseIdentity(arn string) (identity, error) {
+	// arn:partition:service::account:resource
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return identity{}, fmt.Errorf("unexpected caller identity: %s", arn)
+	}
+
+	id := identity{Arn: arn, Partition: parts[1], AccountID: parts[4]}
+	resource := strings.Split(parts[5], "/")
+	id.Type = resource[0]
+	switch {
+	case id.Type == principalRoot && len(resource) == 1:
+		id.Name = principalRoot
+	case id.Type == principalUser && len(resource) >= 2:
+		// users may have a path, the name is always the last part
+		id.Name = resource[len(resource)-1]
+	case id.Type == principalAssumedRole && len(resource) == 3:
+		// covers SSO and instance roles as well: assumed-role/<role>/<session>
+		id.Name = resource[2]
+	case id.Type == principalFederatedUser && len(resource) == 2:
+		id.Name = resource[1]
+	default:
+		return identity{}, fmt.Errorf("unexpected caller identity: %s", arn)
+	}
+
+	return id, nil
+}
+
+// currentIdentity returns who the source profile authenticates as.
+func currentIdentity() identity {
+	id, err := callerIdentity(createSession())
+	internal.ExitOnError(err)
+
+	return id
+}
+
+// callerIdentity returns who the session authenticates as.
+func callerIdentity(sess *session.Session) (identity, error) {
+	result, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return identity{}, err
+	}
+
+	return parseIdentity(*result.Arn)
+}
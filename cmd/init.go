@@ -31,6 +31,22 @@ const shellInit = `
 export ROLLER_PATH='%s';
 
 function roller {
+    local arg;
+    # the command is the first argument which is not a flag, as the global
+    # flags take no values
+    for arg in "$@"; do
+      case "$arg" in
+        -*)
+          ;;
+        exec)
+          # the command needs the terminal, and there is nothing to export
+          ${ROLLER_PATH} "$@";
+          return;;
+        *)
+          break;;
+      esac;
+    done;
+
     ROLLER_SHELL=true ${ROLLER_PATH} "$@" | {
       while IFS= read -r line;
       do
@@ -0,0 +1,129 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/cobra"
+)
+
+var loaderCmd = &cobra.Command{
+	Use:   "loader",
+	Short: "List the configured loaders.",
+	Run: func(cmd *cobra.Command, args []string) {
+		defer internal.ClosePlugins()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tLOADER\tKIND\tAPI\tCAPABILITIES")
+		for _, cfg := range internal.LoaderConfigs() {
+			if internal.BuiltinLoader(cfg.GetLoader()) != nil {
+				fmt.Fprintf(w, "%s\t%s\tbuiltin\t%d\t%s\n", cfg.GetName(), cfg.GetLoader(), pkg.APIVersion, pkg.CapabilityLoad)
+				continue
+			}
+
+			plug, err := internal.OpenPlugin(cfg.GetLoader())
+			if err != nil {
+				fmt.Fprintf(w, "%s\t%s\terror\t-\t%s\n", cfg.GetName(), cfg.GetLoader(), err)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", cfg.GetName(), cfg.GetLoader(), plug.Kind, plug.APIVersion, strings.Join(plug.Capabilities, ","))
+		}
+		w.Flush()
+	},
+}
+
+var loaderDescribeCmd = &cobra.Command{
+	Use:   "describe <loader>",
+	Short: "Describe the options of a plugin loader.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		defer internal.ClosePlugins()
+
+		plug, err := internal.OpenPlugin(args[0])
+		internal.ExitOnError(err)
+
+		if !plug.Has(pkg.CapabilityDescribe) {
+			internal.ExitWithError(fmt.Sprintf("%s does not describe its options.", args[0]), 1)
+		}
+
+		options, err := plug.Describe(context.Background())
+		internal.ExitOnError(err)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "OPTION\tTYPE\tREQUIRED\tDESCRIPTION")
+		for _, o := range options {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", o.Name, o.Type, o.Required, o.Description)
+		}
+		w.Flush()
+	},
+}
+
+var loaderValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the config of the plugin loaders.",
+	Run: func(cmd *cobra.Command, args []string) {
+		defer internal.ClosePlugins()
+
+		valid := true
+		for _, cfg := range internal.LoaderConfigs() {
+			if internal.BuiltinLoader(cfg.GetLoader()) != nil {
+				continue
+			}
+
+			plug, err := internal.OpenPlugin(cfg.GetLoader())
+			if err != nil {
+				fmt.Printf("%s: %s\n", cfg.GetName(), err)
+				valid = false
+				continue
+			}
+			if !plug.Has(pkg.CapabilityValidate) {
+				continue
+			}
+
+			errs, err := plug.Validate(context.Background(), cfg)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			for _, e := range errs {
+				fmt.Printf("%s: %s\n", cfg.GetName(), e)
+				valid = false
+			}
+		}
+
+		if !valid {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(loaderCmd)
+	loaderCmd.AddCommand(loaderDescribeCmd)
+	loaderCmd.AddCommand(loaderValidateCmd)
+}
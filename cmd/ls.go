@@ -0,0 +1,251 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var lsName string
+var lsAccount string
+var lsRole string
+var lsLoader string
+var lsTags []string
+var lsSort string
+var lsOutput string
+var lsTemplate string
+
+type listEntry struct {
+	Name        string            `json:"name" yaml:"name"`
+	AccountID   string            `json:"account_id" yaml:"account_id"`
+	Role        string            `json:"role" yaml:"role"`
+	TTL         string            `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	Via         string            `json:"via,omitempty" yaml:"via,omitempty"`
+	Loader      string            `json:"loader" yaml:"loader"`
+	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Region      string            `json:"region,omitempty" yaml:"region,omitempty"`
+	Owner       string            `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Session     *time.Time        `json:"session_expiration,omitempty" yaml:"session_expiration,omitempty"`
+}
+
+func (e listEntry) sessionState() string {
+	if e.Session == nil {
+		return "-"
+	}
+	if e.Session.Before(time.Now()) {
+		return "expired"
+	}
+
+	return e.Session.Local().Format("2006-01-02 15:04")
+}
+
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the loaded roles.",
+	Long: `List the roles provided by the loaders with their account, role, ttl, loader and
+the expiration of the session if one was created for them. Name, role and tag values
+accept * and ? wildcards, tags are given as key=value, or just key to require the tag.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		entries := listEntries()
+
+		switch lsOutput {
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tACCOUNT\tROLE\tTTL\tLOADER\tSESSION")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Name, e.AccountID, e.Role, e.TTL, e.Loader, e.sessionState())
+			}
+			w.Flush()
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			internal.ExitOnError(encoder.Encode(entries))
+		case "yaml":
+			out, err := yaml.Marshal(entries)
+			internal.ExitOnError(err)
+			fmt.Print(string(out))
+		case "csv":
+			w := csv.NewWriter(os.Stdout)
+			w.Write([]string{"name", "account_id", "role", "ttl", "loader", "session_expiration"})
+			for _, e := range entries {
+				var session string
+				if e.Session != nil {
+					session = e.Session.Format(time.RFC3339)
+				}
+				w.Write([]string{e.Name, e.AccountID, e.Role, e.TTL, e.Loader, session})
+			}
+			w.Flush()
+			internal.ExitOnError(w.Error())
+		case "template":
+			tmpl, err := template.New("ls").Parse(lsTemplate)
+			internal.ExitOnError(err)
+			for _, e := range entries {
+				internal.ExitOnError(tmpl.Execute(os.Stdout, e))
+				fmt.Println()
+			}
+		default:
+			internal.ExitWithError(fmt.Sprintf("Unknown output format: %s", lsOutput), 1)
+		}
+	},
+}
+
+func listEntries() []listEntry {
+	sessions := make(map[string]time.Time)
+	if _, err := os.Stat(internal.CredentialsPath()); err == nil {
+		for name, c := range internal.ReadCredentials().Credentials {
+			sessions[name] = c.Expiration
+		}
+	}
+	for name, c := range internal.ReadSessions().Credentials {
+		if c.Expiration.After(sessions[name]) {
+			sessions[name] = c.Expiration
+		}
+	}
+
+	name := globRegexp(lsName)
+	role := globRegexp(lsRole)
+	tags := make(map[string]*regexp.Regexp, len(lsTags))
+	for _, t := range lsTags {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) == 1 {
+			tags[parts[0]] = nil
+		} else {
+			tags[parts[0]] = globRegexp(parts[1])
+		}
+	}
+
+	entries := make([]listEntry, 0, len(internal.AccountCache))
+	for k, p := range internal.AccountCache {
+		if !name.MatchString(k) ||
+			!role.MatchString(p.Parameters.Role) ||
+			(lsAccount != "" && p.Parameters.AccountID != lsAccount) ||
+			(lsLoader != "" && p.Source != lsLoader) ||
+			!matchTags(p, tags) {
+			continue
+		}
+
+		e := listEntry{
+			Name:        k,
+			AccountID:   p.Parameters.AccountID,
+			Role:        p.Parameters.Role,
+			TTL:         p.Parameters.TTL,
+			Via:         pkg.FormatRoleHops(p.Parameters.Via),
+			Loader:      p.Source,
+			Description: p.Description,
+			Region:      p.Region,
+			Owner:       p.Owner,
+			Tags:        p.Tags,
+		}
+		if expiration, ok := sessions[k]; ok {
+			e.Session = &expiration
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch lsSort {
+		case "account":
+			if a.AccountID != b.AccountID {
+				return a.AccountID < b.AccountID
+			}
+		case "role":
+			if a.Role != b.Role {
+				return a.Role < b.Role
+			}
+		case "loader":
+			if a.Loader != b.Loader {
+				return a.Loader < b.Loader
+			}
+		case "session":
+			if (a.Session == nil) != (b.Session == nil) {
+				return a.Session != nil
+			}
+			if a.Session != nil && !a.Session.Equal(*b.Session) {
+				return a.Session.After(*b.Session)
+			}
+		}
+
+		return a.Name < b.Name
+	})
+
+	return entries
+}
+
+func matchTags(p *pkg.LoadedProfile, tags map[string]*regexp.Regexp) bool {
+	for k, re := range tags {
+		v, ok := p.Tags[k]
+		if !ok || (re != nil && !re.MatchString(v)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// globRegexp turns a pattern with * and ? wildcards into a regexp matching
+// the whole string. An empty pattern matches everything.
+func globRegexp(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+func init() {
+	RootCmd.AddCommand(lsCmd)
+	lsCmd.Flags().StringVar(&lsName, "name", "", "Only list the roles with a matching name.")
+	lsCmd.Flags().StringVar(&lsAccount, "account", "", "Only list the roles in the given account.")
+	lsCmd.Flags().StringVar(&lsRole, "role", "", "Only list the roles with a matching role name.")
+	lsCmd.Flags().StringVar(&lsLoader, "loader", "", "Only list the roles provided by the given loader.")
+	lsCmd.Flags().StringArrayVar(&lsTags, "tag", nil, "Only list the roles with a matching tag, can be repeated.")
+	lsCmd.Flags().StringVar(&lsSort, "sort", "name", "Sort by name, account, role, loader or session.")
+	lsCmd.Flags().StringVarP(&lsOutput, "output", "o", "table", "The output format: table, json, yaml, csv or template.")
+	lsCmd.Flags().StringVar(&lsTemplate, "template", "", "A Go template to render each role with, implies -o template.")
+
+	lsCmd.PreRun = func(cmd *cobra.Command, args []string) {
+		if lsTemplate != "" {
+			lsOutput = "template"
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mitom/roller/internal"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/viper"
+)
+
+// sourceProfileSetting returns a setting for the source profile from the
+// source_profiles section of the config, falling back to the global one.
+func sourceProfileSetting(fromProfile string, key string) string {
+	settings, ok := viper.GetStringMap("source_profiles")[strings.ToLower(fromProfile)].(map[string]interface{})
+	if ok {
+		if v, ok := settings[key]; ok {
+			return fmt.Sprint(v)
+		}
+	}
+
+	return viper.GetString(key)
+}
+
+// mfaSerial returns the MFA device to authenticate the source profile with:
+// the mfa_serial of the profile in the AWS config, the one in the roller
+// config or the virtual device of the IAM user. Empty if there is none.
+func mfaSerial(fromProfile string, id identity) string {
+	if p, ok := internal.ReadAWSProfiles().Profiles[fromProfile]; ok && p.MFASerial != "" {
+		return p.MFASerial
+	}
+	if serial := sourceProfileSetting(fromProfile, "mfa_serial"); serial != "" {
+		return serial
+	}
+
+	return id.UserMFASerial()
+}
+
+// mfaSessionDuration returns how long the MFA session of the source profile
+// should last, 0 if MFA sessions are not to be used. GetSessionToken only
+// takes long-term credentials, so other identities give the MFA to AssumeRole.
+func mfaSessionDuration(fromProfile string, id identity) time.Duration {
+	if id.Type != principalUser && id.Type != principalRoot {
+		return 0
+	}
+
+	value := sourceProfileSetting(fromProfile, "mfa_session_duration")
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		internal.Warn("invalid mfa_session_duration for %s: %s", fromProfile, value)
+		return 0
+	}
+
+	return duration
+}
+
+// mfaSession returns an AWS session for the source profile authenticated
+// with MFA. The session is created with GetSessionToken once and reused until
+// it expires, so roles can be assumed from it without asking for the MFA again.
+func mfaSession(fromProfile string, serial string, username string, duration time.Duration, fresh bool) *session.Session {
+	sessions := internal.ReadMFASessions()
+
+	c, ok := sessions.Credentials[fromProfile]
+	shared := internal.MFASessionsInMemory() && !runningAgent
+	if shared && !ok && !fresh {
+		// another roller may have created it
+		if c, err := internal.AgentMFASession(fromProfile); err == nil {
+			sessions.Add(fromProfile, c)
+		}
+		c, ok = sessions.Credentials[fromProfile]
+	}
+	if fresh || !ok || c.Expiration.Before(time.Now().Add(5*time.Minute)) {
+		mfa := internal.Prompt(fmt.Sprintf("Enter your MFA for %s for your %s profile: ", username, fromProfile))
+		result, err := sts.New(createSession()).GetSessionToken(&sts.GetSessionTokenInput{
+			SerialNumber:    aws.String(serial),
+			TokenCode:       aws.String(mfa),
+			DurationSeconds: aws.Int64(int64(duration.Seconds())),
+		})
+		internal.ExitOnError(err)
+
+		c = &internal.Credential{
+			Expiration: *result.Credentials.Expiration,
+			AccessKey:  *result.Credentials.AccessKeyId,
+			SecretKey:  *result.Credentials.SecretAccessKey,
+			Token:      *result.Credentials.SessionToken,
+		}
+		sessions.Add(fromProfile, c)
+		sessions.Save()
+		if shared {
+			if err := internal.GiveAgentMFASession(fromProfile, c); err != nil && err != internal.ErrAgentNotRunning {
+				internal.Warn("could not hand the MFA session of %s to the agent: %s", fromProfile, err)
+			}
+		} else if !internal.MFASessionsInMemory() && !internal.VaultBackend() {
+			internal.Warn("the MFA session of %s is stored in plaintext in %s", fromProfile, internal.MFASessionsPath())
+		}
+	}
+
+	return sessionWithCredentials(fromProfile, c.AccessKey, c.SecretKey, c.Token)
+}
+
+// sessionWithCredentials returns an AWS session with the given credentials
+// and the rest of the settings, like the region, of the source profile.
+func sessionWithCredentials(fromProfile string, accessKey string, secretKey string, token string) *session.Session {
+	options := sourceSessionOptions(fromProfile)
+	options.Config.Credentials = awscredentials.NewStaticCredentials(accessKey, secretKey, token)
+
+	return session.Must(session.NewSessionWithOptions(options))
+}
+
+// forgetMFASession drops the cached MFA session of the source profile.
+func forgetMFASession(fromProfile string) {
+	sessions := internal.ReadMFASessions()
+	if _, ok := sessions.Credentials[fromProfile]; ok {
+		sessions.Delete(fromProfile)
+		sessions.Save()
+	}
+}
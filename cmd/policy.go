@@ -0,0 +1,110 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var externalID string
+var policyFile string
+var policyArns []string
+var readonly bool
+
+// applySessionOptions overrides the external ID and the session policies of
+// the parameters with the flags given, returning whether there were any.
+func applySessionOptions(cmd *cobra.Command, parameters *pkg.SwitchRoleParameters) bool {
+	flags := cmd.Flags()
+	if flags.Changed("external-id") {
+		parameters.ExternalID = externalID
+	}
+	if flags.Changed("policy-file") {
+		parameters.PolicyFile = policyFile
+	}
+	if flags.Changed("policy-arn") {
+		// an empty value clears the policies
+		parameters.PolicyArns = strings.Fields(strings.Join(policyArns, " "))
+	}
+	if flags.Changed("readonly") {
+		readonlyArn := viper.GetString("readonly_policy_arn")
+		arns := make([]string, 0, len(parameters.PolicyArns)+1)
+		for _, arn := range parameters.PolicyArns {
+			if arn != readonlyArn {
+				arns = append(arns, arn)
+			}
+		}
+		if readonly {
+			arns = append(arns, readonlyArn)
+		}
+		parameters.PolicyArns = arns
+	}
+
+	return sessionOptionsGiven(cmd)
+}
+
+// sessionOptionsGiven tells whether any of the flags of applySessionOptions
+// were given.
+func sessionOptionsGiven(cmd *cobra.Command) bool {
+	flags := cmd.Flags()
+
+	return flags.Changed("external-id") || flags.Changed("policy-file") || flags.Changed("policy-arn") || flags.Changed("readonly")
+}
+
+// applySessionPolicies sets the external ID and the session policies of the
+// role on the input.
+func applySessionPolicies(input *sts.AssumeRoleInput, role pkg.SwitchRoleParameters) {
+	if role.ExternalID != "" {
+		input.ExternalId = aws.String(role.ExternalID)
+	}
+
+	if role.PolicyFile != "" {
+		path, err := pkg.ExpandPath(role.PolicyFile)
+		internal.ExitOnError(err)
+		policy, err := ioutil.ReadFile(path)
+		internal.ExitOnError(err)
+		input.Policy = aws.String(string(policy))
+	}
+
+	for _, arn := range role.PolicyArns {
+		input.PolicyArns = append(input.PolicyArns, &sts.PolicyDescriptorType{Arn: aws.String(arn)})
+	}
+}
+
+// addSessionOptionFlags adds the flags of applySessionOptions to the command.
+func addSessionOptionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&externalID, "external-id", "", "The external ID to assume the role with.")
+	cmd.Flags().StringVar(&policyFile, "policy-file", "", "A file with a session policy (JSON) to limit the permissions of the session with.")
+	cmd.Flags().StringArrayVar(&policyArns, "policy-arn", nil, "The ARN of a managed policy to limit the permissions of the session with, can be repeated.")
+	cmd.Flags().BoolVar(&readonly, "readonly", false, "Limit the session to read only access (the readonly_policy_arn policy).")
+}
+
+func init() {
+	viper.SetDefault("readonly_policy_arn", "arn:aws:iam::aws:policy/ReadOnlyAccess")
+}
@@ -59,4 +59,12 @@ func init() {
 	viper.SetDefault("plugin_dir", path.Join(internal.AppHomePath(), "plugins"))
 	viper.SetDefault("cache_dir", path.Join(internal.AppHomePath(), "cache"))
 	viper.SetDefault("loader", map[string]interface{}{})
+	viper.SetDefault("loader_timeout", "1m")
+
+	RootCmd.PersistentFlags().Bool("dry-run", false, "Only show the changes to the AWS files, without writing them.")
+	RootCmd.PersistentFlags().Bool("confirm", false, "Show the changes to the AWS files and ask before writing them.")
+	RootCmd.PersistentFlags().BoolP("yes", "y", false, "Write the changes to the AWS files without asking.")
+	viper.BindPFlag("dry_run", RootCmd.PersistentFlags().Lookup("dry-run"))
+	viper.BindPFlag("confirm", RootCmd.PersistentFlags().Lookup("confirm"))
+	viper.BindPFlag("yes", RootCmd.PersistentFlags().Lookup("yes"))
 }
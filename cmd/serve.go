@@ -0,0 +1,188 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/cobra"
+)
+
+var serveFollow bool
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the sessions of a role to tools which can not use profiles.",
+	Long: `Serve the sessions of a role over HTTP the way the AWS SDKs find credentials in containers
+and on instances. The served role can follow the roles switched to with 'roller switch'.`,
+}
+
+// servedRole is the role the serve commands hand out the sessions of. When it
+// follows roller, the role switched to last takes its place.
+type servedRole struct {
+	mu     sync.Mutex
+	name   string
+	follow bool
+	// the time of the last history entry looked at
+	since time.Time
+}
+
+// serveArgs accepts an optional role, which can only be left out when there
+// is a role switched to before to follow.
+func serveArgs(cmd *cobra.Command, args []string) error {
+	if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		if len(internal.ReadHistory()) == 0 {
+			return fmt.Errorf("a role has to be given, no role was switched to yet")
+		}
+		return nil
+	}
+	if _, _, exists := roleParameters(args[0]); !exists {
+		return fmt.Errorf("The given role can not be loaded from the cache: %s", args[0])
+	}
+
+	return nil
+}
+
+// newServedRole serves the given role, or follows the roles switched to when
+// there is none.
+func newServedRole(args []string) *servedRole {
+	if len(args) == 0 {
+		return &servedRole{follow: true}
+	}
+
+	return &servedRole{name: args[0], follow: serveFollow, since: time.Now()}
+}
+
+// current returns the role to serve, moving on to the role switched to last
+// when following.
+func (s *servedRole) current() string {
+	history := internal.ReadHistory()
+	if !s.follow || len(history) == 0 || !history[0].Time.After(s.since) {
+		return s.name
+	}
+
+	latest := history[0]
+	s.since = latest.Time
+	if latest.Name == s.name {
+		return s.name
+	}
+	if _, _, ok := roleParameters(latest.Name); !ok {
+		if s.name != "" {
+			internal.Warn("can not serve %s, it is not a role loaded by roller, still serving %s", latest.Name, s.name)
+		} else {
+			internal.Warn("can not serve %s, it is not a role loaded by roller", latest.Name)
+		}
+		return s.name
+	}
+
+	s.name = latest.Name
+	fmt.Fprintf(os.Stderr, "Serving %s\n", s.name)
+
+	return s.name
+}
+
+// servedSession is a session of the served role.
+type servedSession struct {
+	name       string
+	parameters pkg.SwitchRoleParameters
+	region     string
+	credential *internal.Credential
+}
+
+// role returns the role to serve, without a session.
+func (s *servedRole) role() (session servedSession, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer catchFailure(&err)
+
+	session.name = s.current()
+	if session.name == "" {
+		return session, fmt.Errorf("no role to serve")
+	}
+	session.parameters, session.region, _ = roleParameters(session.name)
+
+	return session, nil
+}
+
+// credential returns a session of the served role.
+func (s *servedRole) credential() (servedSession, error) {
+	session, err := s.role()
+	if err != nil {
+		return session, err
+	}
+
+	return s.assume(session)
+}
+
+// assume adds a session of its role to the session. Failures only fail the
+// request, the switch code is not safe for concurrent use so it is serialised.
+func (s *servedRole) assume(session servedSession) (_ servedSession, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer catchFailure(&err)
+
+	// the source profile may differ from the last request
+	awsSession = nil
+	session.credential = roleSession(session.name, session.parameters)
+
+	return session, nil
+}
+
+// roleArn returns the ARN of the role of the session.
+func (s servedSession) roleArn() string {
+	return fmt.Sprintf("arn:aws:iam::%s:role/%s", s.parameters.AccountID, s.parameters.Role)
+}
+
+// randomToken returns a secret for the clients to authenticate with.
+func randomToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	internal.ExitOnError(err)
+
+	return hex.EncodeToString(b)
+}
+
+// printServeEnv prints the environment for the clients to use the server,
+// and writes it to the env file when one is given.
+func printServeEnv(envFile string, env []string) {
+	content := strings.Join(env, "\n") + "\n"
+	fmt.Print(content)
+	if envFile != "" {
+		internal.ExitOnError(ioutil.WriteFile(envFile, []byte(content), 0600))
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+}
@@ -0,0 +1,131 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mitom/roller/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var ecsAddr string
+var ecsEnvFile string
+
+// containerCredentials is the response format of the ECS container
+// credentials endpoint.
+type containerCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+	RoleArn         string
+}
+
+var serveECSCmd = &cobra.Command{
+	Use:   "ecs [role]",
+	Short: "Serve the sessions of a role like the ECS container credentials endpoint.",
+	Long: `Serve the sessions of a role like the ECS container credentials endpoint, for the SDKs
+configured with AWS_CONTAINER_CREDENTIALS_FULL_URI and AWS_CONTAINER_AUTHORIZATION_TOKEN.
+The variables to set are printed, with a new random token on every start.
+
+Without a role, or with --follow, the served role follows the roles switched to with
+'roller switch', so the clients do not have to be restarted. The SDKs only accept plain http
+from a loopback address, so containers have to share the network of the host.`,
+	Args:              serveArgs,
+	ValidArgsFunction: completeRoles,
+	Run: func(cmd *cobra.Command, args []string) {
+		served := newServedRole(args)
+		token := randomToken()
+
+		listener, err := net.Listen("tcp", ecsAddr)
+		internal.ExitOnError(err)
+
+		printServeEnv(ecsEnvFile, []string{
+			fmt.Sprintf("AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s/credentials", listener.Addr()),
+			"AWS_CONTAINER_AUTHORIZATION_TOKEN=" + token,
+		})
+
+		keepRunningOnFailure()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/credentials", containerCredentialsHandler(token, func(r *http.Request) (servedSession, error) {
+			session, err := served.credential()
+			if err != nil {
+				internal.Warn("could not serve a session: %s", err)
+				return session, err
+			}
+			fmt.Fprintf(os.Stderr, "Served %s to %s\n", session.name, r.RemoteAddr)
+
+			return session, nil
+		}))
+
+		fmt.Fprintf(os.Stderr, "Listening on %s\n", listener.Addr())
+		err = http.Serve(listener, mux)
+		// failures do not end roller any more
+		fmt.Println(err)
+		os.Exit(1)
+	},
+}
+
+// containerCredentialsHandler serves the sessions returned by serve to the
+// clients with the token, like the ECS container credentials endpoint.
+func containerCredentialsHandler(token string, serve func(r *http.Request) (servedSession, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(token)) != 1 {
+			http.Error(w, "invalid authorization token", http.StatusUnauthorized)
+			return
+		}
+
+		session, err := serve(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(containerCredentials{
+			AccessKeyId:     session.credential.AccessKey,
+			SecretAccessKey: session.credential.SecretKey,
+			Token:           session.credential.Token,
+			Expiration:      session.credential.Expiration.UTC().Format(time.RFC3339),
+			RoleArn:         session.roleArn(),
+		})
+	}
+}
+
+func init() {
+	serveECSCmd.Flags().StringVar(&ecsAddr, "addr", "127.0.0.1:9911", "The address to listen on.")
+	serveECSCmd.Flags().BoolVar(&serveFollow, "follow", false, "Serve the role switched to last from then on.")
+	serveECSCmd.Flags().StringVar(&ecsEnvFile, "env-file", "", "A file to write the variables for the clients to, e.g. for docker compose.")
+	serveCmd.AddCommand(serveECSCmd)
+}
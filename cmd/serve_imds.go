@@ -0,0 +1,258 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitom/roller/internal"
+
+	"github.com/spf13/cobra"
+)
+
+const imdsMaxTokenTTL = 6 * time.Hour
+
+var imdsAddr string
+var imdsAllowV1 bool
+
+// imds emulates the parts of the instance metadata service the SDKs and
+// tools use to find the credentials, account and region.
+type imds struct {
+	served *servedRole
+	mu     sync.Mutex
+	tokens map[string]time.Time
+}
+
+var serveIMDSCmd = &cobra.Command{
+	Use:   "imds [role]",
+	Short: "Serve the sessions of a role like the instance metadata service.",
+	Long: `Serve the sessions of a role like the EC2 instance metadata service (IMDSv2), for the tools
+which only read credentials from an instance profile. The SDKs use it when
+AWS_EC2_METADATA_SERVICE_ENDPOINT is set to the printed address, other tools may need the
+address 169.254.169.254:80 to be routed to it.
+
+Without a role, or with --follow, the served role follows the roles switched to with
+'roller switch'.`,
+	Args:              serveArgs,
+	ValidArgsFunction: completeRoles,
+	Run: func(cmd *cobra.Command, args []string) {
+		server := &imds{served: newServedRole(args), tokens: make(map[string]time.Time)}
+
+		listener, err := net.Listen("tcp", imdsAddr)
+		internal.ExitOnError(err)
+
+		printServeEnv("", []string{fmt.Sprintf("AWS_EC2_METADATA_SERVICE_ENDPOINT=http://%s/", listener.Addr())})
+
+		keepRunningOnFailure()
+
+		fmt.Fprintf(os.Stderr, "Listening on %s\n", listener.Addr())
+		err = http.Serve(listener, server)
+		// failures do not end roller any more
+		fmt.Println(err)
+		os.Exit(1)
+	},
+}
+
+func (m *imds) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// like the real service, refuse requests which went through a proxy
+	if r.Header.Get("X-Forwarded-For") != "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Path == "/latest/api/token" {
+		m.token(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !m.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	credentialsPath := "/latest/meta-data/iam/security-credentials/"
+	switch path := r.URL.Path; {
+	case path == credentialsPath || path == strings.TrimSuffix(credentialsPath, "/"):
+		m.respond(w, r, "", func(s servedSession) interface{} {
+			return s.parameters.Role
+		})
+	case strings.HasPrefix(path, credentialsPath):
+		m.respond(w, r, strings.TrimPrefix(path, credentialsPath), func(s servedSession) interface{} {
+			return map[string]string{
+				"Code":            "Success",
+				"LastUpdated":     time.Now().UTC().Format(time.RFC3339),
+				"Type":            "AWS-HMAC",
+				"AccessKeyId":     s.credential.AccessKey,
+				"SecretAccessKey": s.credential.SecretKey,
+				"Token":           s.credential.Token,
+				"Expiration":      s.credential.Expiration.UTC().Format(time.RFC3339),
+			}
+		})
+	case path == "/latest/meta-data/iam/info":
+		m.respond(w, r, "", func(s servedSession) interface{} {
+			return map[string]string{
+				"Code":               "Success",
+				"LastUpdated":        time.Now().UTC().Format(time.RFC3339),
+				"InstanceProfileArn": fmt.Sprintf("arn:aws:iam::%s:instance-profile/%s", s.parameters.AccountID, s.parameters.Role),
+				"InstanceProfileId":  "roller",
+			}
+		})
+	case path == "/latest/meta-data/instance-id":
+		m.respond(w, r, "", func(s servedSession) interface{} {
+			return "i-roller"
+		})
+	case path == "/latest/meta-data/placement/region":
+		m.respond(w, r, "", func(s servedSession) interface{} {
+			return imdsRegion(s)
+		})
+	case path == "/latest/meta-data/placement/availability-zone":
+		m.respond(w, r, "", func(s servedSession) interface{} {
+			return imdsRegion(s) + "a"
+		})
+	case path == "/latest/dynamic/instance-identity/document":
+		m.respond(w, r, "", func(s servedSession) interface{} {
+			return map[string]interface{}{
+				"accountId":        s.parameters.AccountID,
+				"architecture":     "x86_64",
+				"availabilityZone": imdsRegion(s) + "a",
+				"imageId":          "ami-roller",
+				"instanceId":       "i-roller",
+				"instanceType":     "roller",
+				"pendingTime":      time.Now().UTC().Format(time.RFC3339),
+				"privateIp":        "127.0.0.1",
+				"region":           imdsRegion(s),
+				"version":          "2017-09-30",
+			}
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// token hands out a session token for the IMDSv2 handshake.
+func (m *imds) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	seconds, err := strconv.Atoi(r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+	ttl := time.Duration(seconds) * time.Second
+	if err != nil || ttl <= 0 || ttl > imdsMaxTokenTTL {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	token := randomToken()
+	m.mu.Lock()
+	now := time.Now()
+	for t, expiration := range m.tokens {
+		if expiration.Before(now) {
+			delete(m.tokens, t)
+		}
+	}
+	m.tokens[token] = now.Add(ttl)
+	m.mu.Unlock()
+
+	w.Header().Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, token)
+}
+
+// authorized checks the session token of the request, which is only
+// optional when IMDSv1 is allowed.
+func (m *imds) authorized(r *http.Request) bool {
+	token := r.Header.Get("X-aws-ec2-metadata-token")
+	if token == "" {
+		return imdsAllowV1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expiration, ok := m.tokens[token]
+
+	return ok && expiration.After(time.Now())
+}
+
+// respond writes what the body function returns for the served role, as
+// plain text or JSON, or not found if it is nil. The body gets a session of
+// the role when credentialRole is given, which is not found without assuming
+// the role when it is not the served one.
+func (m *imds) respond(w http.ResponseWriter, r *http.Request, credentialRole string, body func(servedSession) interface{}) {
+	withCredential := credentialRole != ""
+	session, err := m.served.role()
+	if err == nil && withCredential {
+		if credentialRole != session.parameters.Role {
+			http.NotFound(w, r)
+			return
+		}
+		session, err = m.served.assume(session)
+	}
+	if err != nil {
+		internal.Warn("could not serve %s: %s", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch b := body(session).(type) {
+	case nil:
+		http.NotFound(w, r)
+	case string:
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, b)
+	default:
+		if withCredential {
+			fmt.Fprintf(os.Stderr, "Served %s to %s\n", session.name, r.RemoteAddr)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	}
+}
+
+// imdsRegion is the region of the served role, unless one is given.
+func imdsRegion(s servedSession) string {
+	if region != "" {
+		return region
+	}
+	if s.region != "" {
+		return s.region
+	}
+
+	return "us-east-1"
+}
+
+func init() {
+	serveIMDSCmd.Flags().StringVar(&imdsAddr, "addr", "127.0.0.1:9912", "The address to listen on.")
+	serveIMDSCmd.Flags().BoolVar(&serveFollow, "follow", false, "Serve the role switched to last from then on.")
+	serveIMDSCmd.Flags().BoolVar(&imdsAllowV1, "allow-imdsv1", false, "Also answer requests without a session token.")
+	serveIMDSCmd.Flags().StringVar(&region, "region", "", "The region of the instance. Defaults to the region of the role.")
+	serveCmd.AddCommand(serveIMDSCmd)
+}
@@ -0,0 +1,178 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/viper"
+)
+
+// roleParameters returns what is needed to switch to the named role, either
+// from the cache or from a profile set up by roller, with its default region.
+// The session options set on the profile by switch apply to cached roles too.
+func roleParameters(name string) (pkg.SwitchRoleParameters, string, bool) {
+	profile := rollerProfile(name)
+
+	if loaded, ok := internal.AccountCache[name]; ok {
+		parameters := loaded.Parameters
+		if profile != nil {
+			profileSessionOptions(&parameters, profile)
+		}
+		return parameters, loaded.Region, true
+	}
+
+	if profile == nil {
+		return pkg.SwitchRoleParameters{}, "", false
+	}
+
+	parameters := pkg.SwitchRoleParameters{
+		FromProfile: profile.Profile,
+		AccountID:   profile.Account,
+		Role:        profile.Role,
+		TTL:         profile.TTL,
+		ExternalID:  profile.ExternalID,
+		PolicyFile:  profile.PolicyFile,
+		PolicyArns:  strings.Fields(profile.PolicyArns),
+	}
+	if parameters.FromProfile == "" {
+		parameters.FromProfile = viper.GetString("profile")
+	}
+	via, err := pkg.ParseRoleHops(profile.Via)
+	internal.ExitOnError(err)
+	parameters.Via = via
+
+	return parameters, profile.Region, true
+}
+
+// rollerProfile returns the profile set up by roller with the name, nil if
+// there is none.
+func rollerProfile(name string) *internal.Profile {
+	if _, err := os.Stat(internal.ConfigPath()); err != nil {
+		return nil
+	}
+
+	profile, ok := internal.ReadProfiles().Profiles[name]
+	if !ok || !profile.Roller {
+		return nil
+	}
+
+	return profile
+}
+
+// profileSessionOptions fills the session options the loader does not set
+// from the profile, the way syncParameters does when switching.
+func profileSessionOptions(parameters *pkg.SwitchRoleParameters, profile *internal.Profile) {
+	if parameters.ExternalID == "" {
+		parameters.ExternalID = profile.ExternalID
+	}
+	if parameters.PolicyFile == "" {
+		parameters.PolicyFile = profile.PolicyFile
+	}
+	if len(parameters.PolicyArns) == 0 && profile.PolicyArns != "" {
+		parameters.PolicyArns = strings.Fields(profile.PolicyArns)
+	}
+}
+
+// cachedSession returns a session of the named role which is valid for at
+// least 5 more minutes, looking in roller's own store first and then in the
+// AWS credentials file.
+func cachedSession(name string) *internal.Credential {
+	limit := time.Now().Add(5 * time.Minute)
+
+	if c, ok := internal.ReadSessions().Credentials[name]; ok && c.Expiration.After(limit) {
+		return c
+	}
+
+	if _, err := os.Stat(internal.CredentialsPath()); err != nil {
+		return nil
+	}
+
+	c, ok := internal.ReadCredentials().Credentials[name]
+	if !ok || c.Token == "" || c.Expiration.Before(limit) {
+		return nil
+	}
+
+	return c
+}
+
+// roleSession returns a session of the role from the agent when it is
+// running, otherwise a cached one or a new one.
+func roleSession(name string, parameters pkg.SwitchRoleParameters) *internal.Credential {
+	if c := agentSession(name, parameters, false); c != nil {
+		return c
+	}
+	if c := cachedSession(name); c != nil {
+		return c
+	}
+
+	return assumeRole(name, parameters)
+}
+
+// agentSession asks the agent for a session of the role, which it keeps
+// fresh from then on. It is nil if the agent is not running or failed.
+func agentSession(name string, parameters pkg.SwitchRoleParameters, storeCredentials bool) *internal.Credential {
+	c, err := internal.AgentCredential(internal.AgentRequest{
+		Name:             name,
+		Parameters:       parameters,
+		StoreCredentials: storeCredentials,
+		Reason:           sessionReason(),
+		CredentialsPath:  internal.CredentialsPath(),
+	})
+	if err == internal.ErrAgentNotRunning {
+		return nil
+	} else if err != nil {
+		internal.Warn("the agent could not provide a session of %s: %s", name, err)
+		return nil
+	}
+
+	return c
+}
+
+// assumeRole creates a new session for the role and keeps it in roller's own
+// store, dropping the expired sessions from it.
+func assumeRole(name string, parameters pkg.SwitchRoleParameters) *internal.Credential {
+	switchRoleParameters = &parameters
+	assumed := switchTo(parameters)
+	credential := &internal.Credential{
+		Expiration: *assumed.Expiration,
+		AccessKey:  *assumed.AccessKeyId,
+		SecretKey:  *assumed.SecretAccessKey,
+		Token:      *assumed.SessionToken,
+	}
+
+	sessions := internal.ReadSessions()
+	now := time.Now()
+	for k, c := range sessions.Credentials {
+		if c.Expiration.Before(now) {
+			sessions.Delete(k)
+		}
+	}
+	sessions.Add(name, credential)
+	sessions.Save()
+
+	return credential
+}
@@ -0,0 +1,177 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+var reason string
+
+// sessionData is what the session templates in the config are rendered with.
+type sessionData struct {
+	// Username is the name of the source identity: the IAM user, the session
+	// name of an assumed role or the federated user.
+	Username        string
+	Arn             string
+	AccountID       string
+	Profile         string
+	LocalUser       string
+	Hostname        string
+	Reason          string
+	TargetAccountID string
+	Role            string
+}
+
+// sessionReason is why the role is assumed, from --reason or the config.
+func sessionReason() string {
+	if reason != "" {
+		return reason
+	}
+
+	return viper.GetString("reason")
+}
+
+func newSessionData(id identity, role pkg.SwitchRoleParameters) sessionData {
+	data := sessionData{
+		Username:        id.Name,
+		Arn:             id.Arn,
+		AccountID:       id.AccountID,
+		Profile:         role.FromProfile,
+		Reason:          sessionReason(),
+		TargetAccountID: role.AccountID,
+		Role:            role.Role,
+	}
+	if u, err := user.Current(); err == nil {
+		data.LocalUser = u.Username
+	}
+	data.Hostname, _ = os.Hostname()
+
+	return data
+}
+
+func renderSessionTemplate(key string, text string, data sessionData) string {
+	t, err := template.New(key).Option("missingkey=error").Parse(text)
+	if err != nil {
+		internal.ExitOnError(fmt.Errorf("invalid template for %s: %s", key, err))
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		internal.ExitOnError(fmt.Errorf("invalid template for %s: %s", key, err))
+	}
+
+	return out.String()
+}
+
+// sessionIdentity renders the session.source_identity and session.tags of
+// the config. Tags which render empty, like the reason when none was given,
+// are left out.
+func sessionIdentity(data sessionData) (string, map[string]string) {
+	sourceIdentity := renderSessionTemplate("session.source_identity", viper.GetString("session.source_identity"), data)
+
+	tags := make(map[string]string)
+	for key, text := range sessionTags() {
+		if value := renderSessionTemplate("session.tags."+key, text, data); value != "" {
+			tags[key] = value
+		}
+	}
+
+	return sourceIdentity, tags
+}
+
+// sessionTags returns the session.tags of the config. Viper lowercases the
+// keys, but tag keys are case sensitive, so their case is taken from the
+// config file when it can be read.
+func sessionTags() map[string]string {
+	tags := viper.GetStringMapString("session.tags")
+
+	var raw struct {
+		Session struct {
+			Tags map[string]interface{} `yaml:"tags"`
+		} `yaml:"session"`
+	}
+	read, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil || yaml.Unmarshal(read, &raw) != nil {
+		return tags
+	}
+
+	for key := range raw.Session.Tags {
+		lower := strings.ToLower(key)
+		if text, ok := tags[lower]; ok && key != lower {
+			delete(tags, lower)
+			tags[key] = text
+		}
+	}
+
+	return tags
+}
+
+// applySessionIdentity sets the source identity and the tags on the input.
+// Transitive tags are passed on through a role chain by AWS, so after the
+// first role only the others are set.
+func applySessionIdentity(input *sts.AssumeRoleInput, sourceIdentity string, tags map[string]string, first bool) {
+	if sourceIdentity != "" {
+		input.SourceIdentity = aws.String(sourceIdentity)
+	}
+
+	transitive := make(map[string]bool)
+	for _, key := range viper.GetStringSlice("session.transitive_tag_keys") {
+		// like IAM, compare the tag keys case insensitively
+		transitive[strings.ToLower(key)] = true
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		isTransitive := transitive[strings.ToLower(key)]
+		if isTransitive && !first {
+			continue
+		}
+		input.Tags = append(input.Tags, &sts.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+		if isTransitive {
+			input.TransitiveTagKeys = append(input.TransitiveTagKeys, aws.String(key))
+		}
+	}
+}
+
+func init() {
+	viper.SetDefault("session.name", "{{.Username}}")
+}
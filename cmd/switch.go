@@ -25,15 +25,17 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/internal/picker"
 	"github.com/mitom/roller/pkg"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/skratchdot/open-golang/open"
 	"github.com/spf13/cobra"
@@ -44,15 +46,24 @@ var profileName string
 var fromProfile string
 var accountID string
 var region string
+var defaultRegion string
 var role string
 var browser bool
 var ttl string
+var via string
 
 var awsSession *session.Session
 var profiles *internal.Profiles
 var credentials *internal.Credentials
 var switchRoleParameters *pkg.SwitchRoleParameters
 
+var sessionNameRe = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// AWS limits the sessions of roles assumed with the credentials of another
+// role to an hour, and no session can be shorter than 15 minutes.
+const maxChainedDuration = time.Hour
+const minSessionDuration = 15 * time.Minute
+
 // switchCmd represents the switch command
 var switchCmd = &cobra.Command{
 	Use:     "switch",
@@ -73,148 +84,425 @@ var switchCmd = &cobra.Command{
 	Long: `Create a set of temporary credentials using STS and store them amongst the default AWS configurations.
 After the credentials were created successfully, they can be used in the same way as any other AWS profile by the
 name (-n, --name) specified.`,
-	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-		keys := make([]string, 0, len(internal.AccountCache))
-
-		for k := range internal.AccountCache {
-			keys = append(keys, k)
+	ValidArgsFunction: completeRoles,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 && accountID == "" && role == "" && profileName == "" &&
+			os.Getenv("ROLLER_ACTIVE_PROFILE") == "" && len(internal.AccountCache) > 0 {
+			picked, err := pickRole()
+			if err != nil {
+				internal.Warn("can not show the role picker: %s", err)
+			} else if picked == "" {
+				return
+			} else {
+				args = []string{picked}
+			}
 		}
 
-		return keys, cobra.ShellCompDirectiveNoFileComp
-	},
-	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) > 0 {
-			switchRoleParameters = &internal.AccountCache[args[0]].Parameters
+			loaded := internal.AccountCache[args[0]]
+			switchRoleParameters = &loaded.Parameters
+			defaultRegion = loaded.Region
 			profileName = args[0]
 			if ttl != "" {
 				switchRoleParameters.TTL = ttl
 			}
+			if via != "" {
+				switchRoleParameters.Via = viaHops()
+			}
 		} else {
 			switchRoleParameters = &pkg.SwitchRoleParameters{
 				FromProfile: fromProfile,
 				AccountID:   accountID,
 				Role:        role,
 				TTL:         ttl,
+				Via:         viaHops(),
 			}
 		}
 		if accountID == "" && role == "" && profileName == "" && len(args) == 0 && os.Getenv("ROLLER_ACTIVE_PROFILE") != "" {
 			profileName = os.Getenv("ROLLER_ACTIVE_PROFILE")
 		}
 
-		profiles = internal.ReadProfiles()
-		credentials = internal.ReadCredentials()
+		switchProfile(cmd)
+
+		if !internal.DryRun() {
+			internal.RecordHistory(profileName)
+		}
+	},
+}
 
-		var activeCredentials *sts.Credentials
+// switchProfile sets up the profile and its credentials.
+func switchProfile(cmd *cobra.Command) {
+	profiles = internal.ReadProfiles()
+	credentials = internal.ReadCredentials()
 
-		if profileName == "" {
-			syncAnonRoleParameters()
-		} else {
-			syncNamedRoleParameters(profileName)
+	var activeCredentials *sts.Credentials
+
+	if profile := profiles.Profiles[profileName]; profileName != "" && profile != nil && profile.Synced &&
+		(via != "" || sessionOptionsGiven(cmd)) {
+		// the AWS tools would assume the role of the profile without them
+		internal.ExitOnError(fmt.Errorf("%s is synced and assumed by the AWS tools, the session options and --via "+
+			"can not be applied to it, use roller exec instead", profileName))
+	}
+
+	if profileName == "" {
+		syncAnonRoleParameters()
+	} else {
+		syncNamedRoleParameters(profileName)
+	}
+
+	// the flags take precedence over, and can clear, what the role has, for
+	// this session only: the next switch without them gets a fresh session
+	sessionOptionsChanged := applySessionOptions(cmd, switchRoleParameters)
+	if profile := profiles.Profiles[profileName]; profile.Roller && profile.SessionOptions != sessionOptionsChanged {
+		profile.SessionOptions = sessionOptionsChanged
+		profiles.Update(profileName, profile)
+		sessionOptionsChanged = true
+	}
+
+	if browser {
+		openBrowser()
+	} else if profiles.Profiles[profileName].Synced {
+		// the AWS tools assume the role of the profile themselves
+		profiles.Save()
+		printShellExports()
+	} else if (viper.GetBool("credential_process") || internal.VaultBackend()) && profiles.Profiles[profileName].Roller {
+		// the vault is only useful if the keys are not written in plaintext
+		useCredentialProcess(sessionOptionsChanged)
+		printShellExports()
+	} else {
+		if profile := profiles.Profiles[profileName]; profile.Roller && profile.CredentialProcess != "" {
+			profile.CredentialProcess = ""
+			profiles.Update(profileName, profile)
 		}
 
-		if browser {
-			openBrowser()
-		} else {
-			needsRefresh := true
-			if !profiles.Profiles[profileName].Roller {
-				needsRefresh = false
-			} else {
-				creds, ok := credentials.Credentials[profileName]
+		needsRefresh := true
+		if !profiles.Profiles[profileName].Roller {
+			needsRefresh = false
+		} else if !sessionOptionsChanged {
+			creds, ok := credentials.Credentials[profileName]
 
-				if ok {
-					limit := time.Now()
-					limit.Add(5 * 60 * 1000 * 1000) // 5 minutes in nanoseconds
+			if ok {
+				limit := time.Now()
+				limit.Add(5 * 60 * 1000 * 1000) // 5 minutes in nanoseconds
 
-					if creds.Expiration.After(limit) {
-						needsRefresh = false
-					}
+				if creds.Expiration.After(limit) {
+					needsRefresh = false
 				}
 			}
+		}
 
-			if needsRefresh {
+		if needsRefresh {
+			var credential *internal.Credential
+			if internal.DryRun() {
+				// the role is not assumed on a dry run, so nothing is prompted for
+				credential = dryRunCredential()
+			} else {
+				// the agent keeps the credentials file up to date from then on
+				credential = agentSession(profileName, *switchRoleParameters, true)
+			}
+			if credential == nil {
 				activeCredentials = switchTo(*switchRoleParameters)
-				credentials.Add(profileName, &internal.Credential{
+				credential = &internal.Credential{
 					Expiration: *activeCredentials.Expiration,
 					AccessKey:  *activeCredentials.AccessKeyId,
 					SecretKey:  *activeCredentials.SecretAccessKey,
 					Token:      *activeCredentials.SessionToken,
-				})
-
-				credentials.Save()
+				}
 			}
+			credentials.Add(profileName, credential)
+		}
 
-			if needsRefresh || region != "" {
-				profiles.Save()
-			}
+		if needsRefresh || region != "" {
+			internal.SaveAll(profiles, credentials)
+		}
+
+		printShellExports()
+	}
+}
+
+func completeRoles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	keys := make([]string, 0, len(internal.AccountCache))
+
+	for k := range internal.AccountCache {
+		keys = append(keys, k)
+	}
+
+	return keys, cobra.ShellCompDirectiveNoFileComp
+}
+
+func printShellExports() {
+	// the profile was not written on a dry run
+	if viper.GetBool("shell") && !internal.DryRun() {
+		fmt.Printf("export ROLLER_ACTIVE_PROFILE=%s "+
+			"&& export AWS_PROFILE=%s "+
+			"&& export RPROMPT='<aws:%s>'", profileName, profileName, profileName)
+		if internal.Isolated() {
+			// the AWS tools have to find the profiles where roller keeps them
+			fmt.Printf(" && export AWS_CONFIG_FILE='%s' && export AWS_SHARED_CREDENTIALS_FILE='%s'",
+				internal.ConfigPath(), internal.CredentialsPath())
+		}
+		fmt.Println()
+	}
+}
+
+// useCredentialProcess points the profile at `roller credential-process`
+// and keeps its session in roller's own store instead of the AWS credentials
+// file, removing any keys left there from before. A session kept from before
+// is dropped when the session options changed.
+func useCredentialProcess(sessionOptionsChanged bool) {
+	if !internal.VaultBackend() && !internal.AgentRunning() {
+		// the sessions would only last as long as each call
+		internal.ExitOnError(fmt.Errorf("the sessions of %s would not be kept without the vault or the agent, "+
+			"start roller agent or set credentials_backend: vault", profileName))
+	}
+
+	executable, err := os.Executable()
+	internal.ExitOnError(err)
+
+	profile := profiles.Profiles[profileName]
+	profile.CredentialProcess = fmt.Sprintf("%s credential-process %s", executable, profileName)
+	profiles.Update(profileName, profile)
+
+	if c, ok := credentials.Credentials[profileName]; ok {
+		if c.Token != "" && c.Expiration.After(time.Now()) && !sessionOptionsChanged {
+			sessions := internal.ReadSessions()
+			sessions.Add(profileName, c)
+			sessions.Save()
+		}
+		credentials.Delete(profileName)
+	}
+	if sessionOptionsChanged {
+		sessions := internal.ReadSessions()
+		if _, ok := sessions.Credentials[profileName]; ok {
+			sessions.Delete(profileName)
+			sessions.Save()
+		}
+	}
+
+	// the role is not assumed on a dry run, so nothing is prompted for
+	if !internal.DryRun() {
+		roleSession(profileName, *switchRoleParameters)
+	}
+	internal.SaveAll(profiles, credentials)
+}
+
+// dryRunCredential stands in for the session of the role on a dry run, to
+// show where it would be written.
+func dryRunCredential() *internal.Credential {
+	return &internal.Credential{
+		Expiration: time.Now().Add(time.Hour),
+		AccessKey:  "DRYRUN",
+		SecretKey:  "dry-run",
+		Token:      "dry-run",
+	}
+}
+
+// pickRole lets the user choose from the loaded roles, listing the recently
+// used ones first.
+func pickRole() (string, error) {
+	recent := make(map[string]int)
+	for i, e := range internal.ReadHistory() {
+		recent[e.Name] = i
+	}
+
+	names := make([]string, 0, len(internal.AccountCache))
+	for k := range internal.AccountCache {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ri, iRecent := recent[names[i]]
+		rj, jRecent := recent[names[j]]
+		if iRecent && jRecent {
+			return ri < rj
+		}
+		if iRecent != jRecent {
+			return iRecent
+		}
+
+		return names[i] < names[j]
+	})
+
+	nameWidth, roleWidth := 0, 0
+	for _, name := range names {
+		if len(name) > nameWidth {
+			nameWidth = len(name)
+		}
+		if r := internal.AccountCache[name].Parameters.Role; len(r) > roleWidth {
+			roleWidth = len(r)
+		}
+	}
+
+	items := make([]picker.Item, len(names))
+	for i, name := range names {
+		p := internal.AccountCache[name]
+
+		tags := make([]string, 0, len(p.Tags))
+		for k, v := range p.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
 
-			if viper.GetBool("shell") {
-				fmt.Printf("export ROLLER_ACTIVE_PROFILE=%s "+
-					"&& export AWS_PROFILE=%s "+
-					"&& export RPROMPT='<aws:%s>'\n", profileName, profileName, profileName)
+		preview := []string{
+			fmt.Sprintf("Account:     %s", p.Parameters.AccountID),
+			fmt.Sprintf("Role:        %s", p.Parameters.Role),
+		}
+		for _, field := range [][2]string{
+			{"Description", p.Description},
+			{"Owner", p.Owner},
+			{"Region", p.Region},
+			{"TTL", p.Parameters.TTL},
+			{"Loader", p.Source},
+			{"Tags", strings.Join(tags, ", ")},
+		} {
+			if field[1] != "" {
+				preview = append(preview, fmt.Sprintf("%-12s %s", field[0]+":", field[1]))
 			}
 		}
-	},
+
+		_, isRecent := recent[name]
+		items[i] = picker.Item{
+			Value:   name,
+			Label:   fmt.Sprintf("%-*s  %-12s  %-*s  %s", nameWidth, name, p.Parameters.AccountID, roleWidth, p.Parameters.Role, strings.Join(tags, " ")),
+			Preview: preview,
+			Recent:  isRecent,
+		}
+	}
+
+	return picker.Run(items)
 }
 
 func createSession() *session.Session {
 	if awsSession != nil {
 		return awsSession
 	}
-	awsSession = session.Must(session.NewSessionWithOptions(session.Options{
-		Profile: switchRoleParameters.FromProfile,
-	}))
+	awsSession = session.Must(session.NewSessionWithOptions(sourceSessionOptions(switchRoleParameters.FromProfile)))
 
 	return awsSession
 }
 
-func currentAccount() (string, string) {
-	svc := iam.New(createSession())
-	regex, _ := regexp.Compile(`User: (arn:aws:iam::\d+:user/.+) is`)
-	result, err := svc.GetUser(&iam.GetUserInput{})
-	var arn string
-	var match []string
+// sourceSessionOptions returns the options of an AWS session of the source
+// profile, which is always read from the user's AWS files, even when they
+// are overridden for the shell in isolated mode.
+func sourceSessionOptions(fromProfile string) session.Options {
+	return session.Options{
+		Profile:           fromProfile,
+		SharedConfigFiles: []string{internal.AWSConfigPath(), internal.AWSCredentialsPath()},
+	}
+}
+
+func switchTo(role pkg.SwitchRoleParameters) *sts.Credentials {
+	id := currentIdentity()
+	tokenDuration, err := time.ParseDuration(role.TTL)
 	if err != nil {
-		match = regex.FindStringSubmatch(err.Error())
+		tokenDuration, _ = time.ParseDuration("1h")
+	}
 
-		if match != nil {
-			arn = match[1]
-		} else {
-			internal.ExitOnError(err)
+	hops := append(append([]pkg.RoleHop{}, role.Via...), pkg.RoleHop{AccountID: role.AccountID, Role: role.Role})
+	// assuming a role with the session of another role, like an SSO one, is
+	// chaining as well
+	if (len(hops) > 1 || id.Type == principalAssumedRole) && tokenDuration > maxChainedDuration {
+		internal.Warn("a session of a chained role can last at most %s, requesting that instead of %s", maxChainedDuration, tokenDuration)
+		tokenDuration = maxChainedDuration
+	}
+
+	data := newSessionData(id, role)
+	name := renderSessionTemplate("session.name", viper.GetString("session.name"), data)
+	sourceIdentity, tags := sessionIdentity(data)
+
+	var result *sts.Credentials
+	for i, hop := range hops {
+		duration := tokenDuration
+		if i < len(hops)-1 {
+			// the sessions on the way are only used to assume the next role
+			duration = minSessionDuration
 		}
-	} else {
-		arn = *result.User.Arn
+		input := assumeRoleInput(hop, name, duration)
+		applySessionIdentity(input, sourceIdentity, tags, i == 0)
+		if i == len(hops)-1 {
+			applySessionPolicies(input, role)
+		}
+
+		if i == 0 {
+			result = assumeFromSource(role.FromProfile, id, input)
+			continue
+		}
+		assumed, err := sts.New(sessionWithCredentials(role.FromProfile, *result.AccessKeyId, *result.SecretAccessKey, *result.SessionToken)).AssumeRole(input)
+		internal.ExitOnError(err)
+		result = assumed.Credentials
 	}
 
-	regex, _ = regexp.Compile(`arn:aws:iam::(\d+):user/(.+)`)
-	match = regex.FindStringSubmatch(arn)
+	return result
+}
+
+func assumeRoleInput(hop pkg.RoleHop, name string, duration time.Duration) *sts.AssumeRoleInput {
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(fmt.Sprintf("arn:aws:iam::%s:role/%s", hop.AccountID, hop.Role)),
+		RoleSessionName: aws.String(sessionName(name)),
+		DurationSeconds: aws.Int64(int64(duration.Seconds())),
+	}
+	if hop.ExternalID != "" {
+		input.ExternalId = aws.String(hop.ExternalID)
+	}
 
-	return match[1], match[2]
+	return input
 }
 
-func switchTo(role pkg.SwitchRoleParameters) *sts.Credentials {
-	currentAccountID, username := currentAccount()
-	tokenDuration, err := time.ParseDuration(role.TTL)
-	if err != nil {
-		tokenDuration, _ = time.ParseDuration("1h")
+// assumeFromSource assumes a role with the credentials of the source profile,
+// authenticating with MFA when the identity has a device.
+func assumeFromSource(fromProfile string, id identity, input *sts.AssumeRoleInput) *sts.Credentials {
+	serial := mfaSerial(fromProfile, id)
+	if serial == "" {
+		// roles, federated users and SSO sessions authenticate without MFA here
+		result, err := sts.New(createSession()).AssumeRole(input)
+		internal.ExitOnError(err)
+
+		return result.Credentials
 	}
 
-	svc := sts.New(createSession())
+	mfaDuration := mfaSessionDuration(fromProfile, id)
+	if mfaDuration <= 0 {
+		input.SerialNumber = aws.String(serial)
+		input.TokenCode = aws.String(internal.Prompt(fmt.Sprintf("Enter your MFA for %s for your %s profile: ", id.Name, fromProfile)))
+		result, err := sts.New(createSession()).AssumeRole(input)
+		internal.ExitOnError(err)
 
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("Enter your MFA for %s for your %s profile: \n", username, role.FromProfile)
-	mfa, _ := reader.ReadString('\n')
-	result, err := svc.AssumeRole(&sts.AssumeRoleInput{
-		RoleArn:         aws.String(fmt.Sprintf("arn:aws:iam::%s:role/%s", role.AccountID, role.Role)),
-		RoleSessionName: aws.String(username),
-		SerialNumber:    aws.String(fmt.Sprintf("arn:aws:iam::%s:mfa/%s", currentAccountID, username)),
-		TokenCode:       aws.String(strings.Trim(mfa, "\n")),
-		DurationSeconds: aws.Int64(int64(tokenDuration.Seconds())),
-	})
+		return result.Credentials
+	}
+
+	result, err := sts.New(mfaSession(fromProfile, serial, id.Name, mfaDuration, false)).AssumeRole(input)
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "ExpiredToken" || aerr.Code() == "InvalidClientTokenId") {
+		// the cached session is no longer valid, try once more with a new one
+		internal.Warn("could not assume the role with the cached MFA session: %s", aerr.Message())
+		forgetMFASession(fromProfile)
+		result, err = sts.New(mfaSession(fromProfile, serial, id.Name, mfaDuration, true)).AssumeRole(input)
+	}
 	internal.ExitOnError(err)
 
 	return result.Credentials
 }
 
+// viaHops parses the --via flag.
+func viaHops() []pkg.RoleHop {
+	hops, err := pkg.ParseRoleHops(via)
+	internal.ExitOnError(err)
+
+	return hops
+}
+
+// sessionName makes the name usable as a RoleSessionName.
+func sessionName(name string) string {
+	name = sessionNameRe.ReplaceAllString(name, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	if len(name) < 2 {
+		// AWS requires at least 2 characters
+		name = "roller-" + name
+	}
+
+	return name
+}
+
 func syncNamedRoleParameters(name string) {
 	profile, ok := profiles.Profiles[name]
 	if !ok {
@@ -277,8 +565,22 @@ func syncParameters(profile *internal.Profile) {
 		switchRoleParameters.TTL = profile.TTL
 	}
 
+	if len(switchRoleParameters.Via) > 0 {
+		profile.Via = pkg.FormatRoleHops(switchRoleParameters.Via)
+	} else if profile.Via != "" {
+		hops, err := pkg.ParseRoleHops(profile.Via)
+		internal.ExitOnError(err)
+		switchRoleParameters.Via = hops
+	}
+
+	// the session options are not written to the profile, only the ones set
+	// in it by hand are used
+	profileSessionOptions(switchRoleParameters, profile)
+
 	if region != "" {
 		profile.Region = region
+	} else if profile.Region == "" {
+		profile.Region = defaultRegion
 	}
 }
 
@@ -299,7 +601,12 @@ func init() {
 	switchCmd.Flags().StringVar(&accountID, "account", "", "The account id to switch to.")
 	switchCmd.Flags().StringVar(&role, "role", "", "The AWS role name to switch to.")
 	switchCmd.Flags().StringVar(&ttl, "ttl", "", "The session duration to request when assuming the role.")
+	switchCmd.Flags().StringVar(&via, "via", "", "The roles to assume before the role, as <account id>/<role>[:<external id>] separated by '>'.")
 	switchCmd.Flags().BoolVarP(&browser, "web", "w", false, "Open a browser tab to switch to the role.")
+	switchCmd.Flags().Bool("credential-process", false, "Set up the profile to get its credentials from roller instead of storing them in the AWS credentials file.")
+	viper.BindPFlag("credential_process", switchCmd.Flags().Lookup("credential-process"))
+	addSessionOptionFlags(switchCmd)
+	switchCmd.Flags().StringVar(&reason, "reason", "", "Why the role is assumed, e.g. a ticket number, for the session templates.")
 
 	switchCmd.RegisterFlagCompletionFunc("name", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		profiles := internal.ReadProfiles()
@@ -312,4 +619,5 @@ func init() {
 	})
 	RootCmd.AddCommand(switchCmd)
 	viper.SetDefault("profile", "default")
+	viper.SetDefault("mfa_session_duration", "12h")
 }
@@ -0,0 +1,227 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Write the loaded roles to the AWS config as profiles assumed by the AWS tools.",
+	Long: `Write every loaded role to the AWS config as a profile with role_arn, source_profile,
+mfa_serial, duration_seconds, external_id and region, so the AWS CLI and SDKs assume the roles
+themselves instead of using keys written by roller. The profiles are marked with roller_sync;
+those whose role is not loaded any more are removed, and those whose role is loaded under a new
+name are renamed. Switching to a synced profile only selects it.
+
+Roles assumed through other roles or with session policies can not be synced. The mfa_serial
+is taken from the source profile or the roller config, or is the virtual device of the IAM user
+of the source profile like when switching.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		syncProfiles()
+	},
+}
+
+func syncProfiles() {
+	profiles = internal.ReadProfiles()
+	credentials = internal.ReadCredentials()
+
+	names := make([]string, 0, len(internal.AccountCache))
+	for name := range internal.AccountCache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the synced profiles which are not loaded any more, by their role
+	stale := make(map[string][]string)
+	for name, profile := range profiles.Profiles {
+		if _, ok := internal.AccountCache[name]; !ok && profile.Roller && profile.Synced {
+			stale[profile.GenerateName()] = append(stale[profile.GenerateName()], name)
+		}
+	}
+	for _, olds := range stale {
+		sort.Strings(olds)
+	}
+	identities := make(map[string]identity)
+
+	for _, name := range names {
+		loaded := internal.AccountCache[name]
+		synced, ok := nativeProfile(name, loaded, identities)
+		if !ok {
+			continue
+		}
+
+		profile, exists := profiles.Profiles[name]
+		if !exists {
+			if olds := stale[synced.GenerateName()]; len(olds) > 0 {
+				old := olds[0]
+				stale[synced.GenerateName()] = olds[1:]
+				keepMFASerial(synced, profiles.Profiles[old], identities)
+				profiles.Rename(old, name)
+				profiles.Update(name, synced)
+				profiles.Profiles[name] = synced
+				fmt.Printf("Renamed %s to %s\n", old, name)
+				continue
+			}
+			profiles.Add(name, synced)
+			fmt.Printf("Added %s\n", name)
+			continue
+		}
+		if !profile.Roller {
+			internal.Warn("%s is not managed by roller, not syncing it", name)
+			continue
+		}
+		if _, ok := credentials.Credentials[name]; ok {
+			// the keys would take precedence over role_arn for some tools
+			credentials.Delete(name)
+		}
+		if synced.Region == "" {
+			synced.Region = profile.Region
+		}
+		keepMFASerial(synced, profile, identities)
+		if reflect.DeepEqual(profile, synced) {
+			continue
+		}
+		profiles.Update(name, synced)
+		profiles.Profiles[name] = synced
+		fmt.Printf("Updated %s\n", name)
+	}
+
+	if len(internal.FailedLoaders) > 0 && staleCount(stale) > 0 {
+		// their roles may be missing, not removed
+		internal.Warn("not removing the profiles which are not loaded, the loaders failed: %s",
+			strings.Join(internal.FailedLoaders, ", "))
+	} else {
+		for _, olds := range stale {
+			for _, name := range olds {
+				profiles.Delete(name)
+				fmt.Printf("Removed %s\n", name)
+			}
+		}
+	}
+
+	internal.SaveAll(profiles, credentials)
+}
+
+// staleCount returns the number of stale profiles left.
+func staleCount(stale map[string][]string) int {
+	count := 0
+	for _, olds := range stale {
+		count += len(olds)
+	}
+
+	return count
+}
+
+// nativeProfile returns the profile the AWS tools can assume the loaded role
+// with, false if it can not be done without roller. identities keeps the
+// source identities resolved so far.
+func nativeProfile(name string, loaded *pkg.LoadedProfile, identities map[string]identity) (*internal.Profile, bool) {
+	parameters := loaded.Parameters
+	if len(parameters.Via) > 0 {
+		internal.Warn("%s is assumed through other roles, not syncing it", name)
+		return nil, false
+	}
+	if parameters.PolicyFile != "" || len(parameters.PolicyArns) > 0 {
+		internal.Warn("%s has session policies, not syncing it", name)
+		return nil, false
+	}
+
+	fromProfile := parameters.FromProfile
+	if fromProfile == "" {
+		fromProfile = viper.GetString("profile")
+	}
+
+	profile := &internal.Profile{
+		Profile:       parameters.FromProfile,
+		Account:       parameters.AccountID,
+		Role:          parameters.Role,
+		Region:        loaded.Region,
+		Roller:        true,
+		RoleArn:       fmt.Sprintf("arn:aws:iam::%s:role/%s", parameters.AccountID, parameters.Role),
+		TTL:           parameters.TTL,
+		ExternalID:    parameters.ExternalID,
+		MFASerial:     mfaSerial(fromProfile, identity{}),
+		SourceProfile: fromProfile,
+		Synced:        true,
+	}
+	if profile.MFASerial == "" {
+		// the virtual device of an IAM user, like switch uses
+		profile.MFASerial = sourceIdentity(fromProfile, identities).UserMFASerial()
+	}
+	if parameters.TTL != "" {
+		duration, err := time.ParseDuration(parameters.TTL)
+		if err != nil {
+			internal.Warn("invalid ttl for %s: %s", name, parameters.TTL)
+		} else {
+			profile.DurationSeconds = strconv.Itoa(int(duration.Seconds()))
+		}
+	}
+
+	return profile, true
+}
+
+// keepMFASerial keeps the mfa_serial of the existing profile when the
+// identity of the source profile could not be told, instead of dropping it.
+func keepMFASerial(synced *internal.Profile, existing *internal.Profile, identities map[string]identity) {
+	if synced.MFASerial == "" && identities[synced.SourceProfile].Arn == "" {
+		synced.MFASerial = existing.MFASerial
+	}
+}
+
+// sourceIdentity returns who the source profile authenticates as, keeping it
+// in identities. An identity which can not be told is warned about and left
+// empty, so no device is derived from it.
+func sourceIdentity(fromProfile string, identities map[string]identity) identity {
+	if id, ok := identities[fromProfile]; ok {
+		return id
+	}
+
+	sess, err := session.NewSessionWithOptions(sourceSessionOptions(fromProfile))
+	var id identity
+	if err == nil {
+		id, err = callerIdentity(sess)
+	}
+	if err != nil {
+		internal.Warn("can not tell who %s is, keeping the mfa_serial of its profiles: %s", fromProfile, err)
+	}
+	identities[fromProfile] = id
+
+	return id
+}
+
+func init() {
+	RootCmd.AddCommand(syncCmd)
+}
@@ -0,0 +1,181 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/viper"
+)
+
+// ErrAgentNotRunning is returned by AgentCredential when there is no agent
+// to ask.
+var ErrAgentNotRunning = errors.New("the agent is not running")
+
+// AgentRequest asks the agent for a session of a role. The agent keeps it
+// fresh from then on, and when StoreCredentials is set it also stores the
+// sessions it refreshes in the credentials file of the client.
+type AgentRequest struct {
+	Name             string
+	Parameters       pkg.SwitchRoleParameters
+	StoreCredentials bool `json:",omitempty"`
+	// Reason is the reason the client renders the session templates with.
+	Reason string `json:",omitempty"`
+	// CredentialsPath is the credentials file of the client to store the
+	// session in.
+	CredentialsPath string `json:",omitempty"`
+	// MFA asks for the MFA session of the source profile Name instead, or
+	// hands it to the agent when Credential is set, as the MFA sessions are
+	// only kept in memory without the vault.
+	MFA        bool        `json:",omitempty"`
+	Credential *Credential `json:",omitempty"`
+}
+
+type AgentResponse struct {
+	Credential *Credential `json:",omitempty"`
+	Error      string      `json:",omitempty"`
+}
+
+// AgentSocketPath returns the path of the socket the agent listens on.
+func AgentSocketPath() string {
+	if p := viper.GetString("agent_socket"); p != "" {
+		if expanded, err := pkg.ExpandPath(p); err == nil {
+			return expanded
+		}
+	}
+
+	return path.Join(AppHomePath(), "agent.sock")
+}
+
+// AgentCredential asks the running agent for a session of the role.
+func AgentCredential(request AgentRequest) (*Credential, error) {
+	return askAgent(request)
+}
+
+// AgentMFASession asks the running agent for the MFA session of the source
+// profile.
+func AgentMFASession(profile string) (*Credential, error) {
+	return askAgent(AgentRequest{Name: profile, MFA: true})
+}
+
+// GiveAgentMFASession hands the MFA session of the source profile to the
+// running agent, so the other roller processes can use it too.
+func GiveAgentMFASession(profile string, credential *Credential) error {
+	_, err := askAgent(AgentRequest{Name: profile, MFA: true, Credential: credential})
+
+	return err
+}
+
+func askAgent(request AgentRequest) (*Credential, error) {
+	conn, err := net.DialTimeout("unix", AgentSocketPath(), time.Second)
+	if err != nil {
+		return nil, ErrAgentNotRunning
+	}
+	defer conn.Close()
+
+	// the agent may have to assume the role first
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, err
+	}
+
+	var response AgentResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	if response.Credential == nil {
+		return nil, errors.New("the agent returned no credentials")
+	}
+
+	return response.Credential, nil
+}
+
+// AgentRunning tells whether an agent listens on the socket.
+func AgentRunning() bool {
+	conn, err := net.DialTimeout("unix", AgentSocketPath(), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
+
+// ListenAgent creates the socket of the agent, which only the user can use.
+// A socket left behind by an agent which is no longer running is replaced.
+func ListenAgent() (*net.UnixListener, error) {
+	socket := AgentSocketPath()
+	if AgentRunning() {
+		return nil, fmt.Errorf("an agent is already running on %s", socket)
+	}
+	os.Remove(socket)
+
+	if err := os.MkdirAll(path.Dir(socket), 0700); err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// CheckPeer makes sure the process on the other end of the connection runs
+// as the same user as roller.
+func CheckPeer(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var uid int
+	var peerErr error
+	err = raw.Control(func(fd uintptr) {
+		uid, peerErr = peerUID(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	if peerErr != nil {
+		return peerErr
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("refusing the connection of user %d", uid)
+	}
+
+	return nil
+}
@@ -21,22 +21,40 @@
 package internal
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path"
+	"strings"
+
+	"golang.org/x/term"
 )
 
+// Fail ends roller with the error. The agent replaces it, so an error only
+// fails the request it is handling.
+var Fail = func(err string, code int) {
+	fmt.Println(err)
+	os.Exit(code)
+}
+
+// Interactive is false when there is nobody to prompt, like in the agent.
+var Interactive = true
+
 func ExitOnError(err error) {
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		Fail(err.Error(), 1)
 	}
 }
 
 func ExitWithError(err string, code int) {
-	fmt.Println(err)
-	os.Exit(code)
+	Fail(err, code)
+}
+
+// Warn reports a problem which does not stop the current command.
+func Warn(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", a...)
 }
 
 func PanicOnError(err error) {
@@ -45,6 +63,64 @@ func PanicOnError(err error) {
 	}
 }
 
+// Prompt asks the user for a line of input on stderr. When stderr is
+// captured, e.g. when roller runs as a credential_process, the terminal is
+// used directly instead.
+func Prompt(message string) string {
+	if !Interactive {
+		Fail(fmt.Sprintf("can not ask for input: %s", strings.TrimSpace(message)), 1)
+	}
+
+	var in io.Reader = os.Stdin
+	var out io.Writer = os.Stderr
+	if term.IsTerminal(int(os.Stdin.Fd())) && !term.IsTerminal(int(os.Stderr.Fd())) {
+		if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+			defer tty.Close()
+			in, out = tty, tty
+		}
+	}
+
+	fmt.Fprintln(out, message)
+	input, _ := bufio.NewReader(in).ReadString('\n')
+
+	return strings.TrimSpace(input)
+}
+
+// PromptSecret asks for a value without echoing it. It fails when there is
+// no terminal to read it from.
+func PromptSecret(message string) string {
+	if !Interactive {
+		Fail(fmt.Sprintf("can not ask for input: %s", strings.TrimSpace(message)), 1)
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		// like on windows, where the terminal can only be reached through stdin
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			// never echo the secret instead
+			Fail(fmt.Sprintf("can not ask for a secret without a terminal: %s", strings.TrimSpace(message)), 1)
+		}
+		fmt.Fprint(os.Stderr, message)
+		input, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return ""
+		}
+
+		return strings.TrimSpace(string(input))
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, message)
+	input, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(input))
+}
+
 func HomePath() string {
 	usr, err := user.Current()
 	ExitOnError(err)
@@ -22,22 +22,37 @@ package internal
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/spf13/viper"
 	"gopkg.in/ini.v1"
 )
 
 type Profile struct {
-	Profile string `ini:"roller_profile,omitempty"`
-	Account string `ini:"roller_account"`
-	Role    string `ini:"roller_role"`
-	Region  string `ini:"region,omitempty"`
-	Roller  bool   `ini:"roller"`
-	RoleArn string `ini:"role_arn,omitempty"`
-	TTL     string `ini:"roller_ttl,omitempty"`
+	Profile           string `ini:"roller_profile,omitempty"`
+	Account           string `ini:"roller_account"`
+	Role              string `ini:"roller_role"`
+	Region            string `ini:"region,omitempty"`
+	Roller            bool   `ini:"roller"`
+	RoleArn           string `ini:"role_arn,omitempty"`
+	TTL               string `ini:"roller_ttl,omitempty"`
+	Via               string `ini:"roller_via,omitempty"`
+	ExternalID        string `ini:"external_id,omitempty"`
+	PolicyFile        string `ini:"roller_policy_file,omitempty"`
+	PolicyArns        string `ini:"roller_policy_arns,omitempty"`
+	CredentialProcess string `ini:"credential_process,omitempty"`
+	MFASerial         string `ini:"mfa_serial,omitempty"`
+	SourceProfile     string `ini:"source_profile,omitempty"`
+	DurationSeconds   string `ini:"duration_seconds,omitempty"`
+	// Synced profiles are assumed by the AWS tools themselves, see roller sync.
+	Synced bool `ini:"roller_sync,omitempty"`
+	// SessionOptions marks the session of the profile as created with one-off
+	// session options, which the next switch without them does not reuse.
+	SessionOptions bool `ini:"roller_session_options,omitempty"`
 }
 
 func (p Profile) GenerateName() string {
@@ -52,12 +67,12 @@ func (p Profile) ParseRoleArn() (string, string) {
 }
 
 type Profiles struct {
-	data     *ini.File
+	iniFile
 	Profiles map[string]*Profile
 }
 
-func NewProfiles(data *ini.File) Profiles {
-	profiles := Profiles{data, make(map[string]*Profile)}
+func NewProfiles(data *ini.File, path string) Profiles {
+	profiles := Profiles{newIniFile(data, path), make(map[string]*Profile)}
 
 	return profiles
 }
@@ -68,16 +83,56 @@ func (p Profiles) Add(name string, profile *Profile) {
 	profile.Roller = true
 	section.ReflectFrom(profile)
 	p.Profiles[name] = profile
+	p.changed[section.Name()] = true
 }
 
 func (p Profiles) Update(name string, profile *Profile) {
 	section := p.data.Section("profile " + name)
 	section.ReflectFrom(profile)
+	p.changed[section.Name()] = true
+	// ReflectFrom leaves the keys of emptied fields in place
+	optional := map[string]string{
+		"credential_process": profile.CredentialProcess,
+		"roller_via":         profile.Via,
+		"external_id":        profile.ExternalID,
+		"roller_policy_file": profile.PolicyFile,
+		"roller_policy_arns": profile.PolicyArns,
+		"role_arn":           profile.RoleArn,
+		"mfa_serial":         profile.MFASerial,
+		"source_profile":     profile.SourceProfile,
+		"duration_seconds":   profile.DurationSeconds,
+	}
+	for key, value := range optional {
+		if value == "" {
+			section.DeleteKey(key)
+		}
+	}
+	if !profile.SessionOptions {
+		section.DeleteKey("roller_session_options")
+	}
+}
+
+// Rename moves the profile to a new name, keeping the keys roller does not
+// know about.
+func (p Profiles) Rename(name string, newName string) {
+	old := p.data.Section("profile " + name)
+	section, err := p.data.NewSection("profile " + newName)
+	PanicOnError(err)
+	section.Comment = old.Comment
+	for _, key := range old.Keys() {
+		k, err := section.NewKey(key.Name(), key.Value())
+		PanicOnError(err)
+		k.Comment = key.Comment
+	}
+	p.Profiles[newName] = p.Profiles[name]
+	p.changed[section.Name()] = true
+	p.Delete(name)
 }
 
 func (p Profiles) Delete(name string) {
 	delete(p.Profiles, name)
 	p.data.DeleteSection("profile " + name)
+	p.changed["profile "+name] = true
 }
 
 func (p Profiles) Load(section *ini.Section) {
@@ -90,8 +145,10 @@ func (p Profiles) Load(section *ini.Section) {
 	p.Profiles[strings.TrimPrefix(section.Name(), "profile ")] = profile
 }
 
+// Save writes the profiles roller added, updated or deleted to the config,
+// leaving the rest of it untouched.
 func (p Profiles) Save() {
-	p.data.SaveTo(HomePath() + "/.aws/config")
+	SaveAll(p)
 }
 
 type Credential struct {
@@ -102,12 +159,12 @@ type Credential struct {
 }
 
 type Credentials struct {
-	data        *ini.File
+	iniFile
 	Credentials map[string]*Credential
 }
 
-func NewCredentials(data *ini.File) Credentials {
-	credentials := Credentials{data, make(map[string]*Credential)}
+func NewCredentials(data *ini.File, path string) Credentials {
+	credentials := Credentials{newIniFile(data, path), make(map[string]*Credential)}
 
 	return credentials
 }
@@ -117,11 +174,13 @@ func (c Credentials) Add(name string, credential *Credential) {
 	PanicOnError(err)
 	section.ReflectFrom(credential)
 	c.Credentials[name] = credential
+	c.changed[name] = true
 }
 
 func (c Credentials) Delete(name string) {
 	delete(c.Credentials, name)
 	c.data.DeleteSection(name)
+	c.changed[name] = true
 }
 
 func (c Credentials) Load(section *ini.Section) {
@@ -134,15 +193,95 @@ func (c Credentials) Load(section *ini.Section) {
 	c.Credentials[section.Name()] = credential
 }
 
+// Save writes the credentials roller added or deleted to the file, leaving
+// the rest of it untouched.
 func (c Credentials) Save() {
-	c.data.SaveTo(path.Join(HomePath(), ".aws", "credentials"))
+	SaveAll(c)
+}
+
+// Store is a file of profiles or credentials roller changes.
+type Store interface {
+	file() iniFile
+}
+
+// SaveAll writes the changes to the files together, like Save does for one.
+// The changes to the AWS files are reviewed at once, so either all of them
+// are written or none are.
+func SaveAll(stores ...Store) {
+	files := make([]iniFile, 0, len(stores))
+	for _, s := range stores {
+		files = append(files, s.file())
+	}
+
+	ExitOnError(saveIni(files...))
+}
+
+// Isolated tells whether roller keeps the profiles it manages in its own
+// files instead of the ones of the AWS CLI.
+func Isolated() bool {
+	return viper.GetBool("isolated")
+}
+
+// ConfigPath returns the path of the config file roller manages the
+// profiles in.
+func ConfigPath() string {
+	if Isolated() {
+		return path.Join(AppHomePath(), "aws", "config")
+	}
+
+	return AWSConfigPath()
+}
+
+// CredentialsPath returns the path of the credentials file roller keeps the
+// sessions of the profiles in.
+func CredentialsPath() string {
+	if Isolated() {
+		return path.Join(AppHomePath(), "aws", "credentials")
+	}
+
+	return AWSCredentialsPath()
+}
+
+// AWSConfigPath returns the path of the user's AWS config file, where the
+// source profiles are.
+func AWSConfigPath() string {
+	return awsPath("AWS_CONFIG_FILE", "config")
+}
+
+// AWSCredentialsPath returns the path of the user's AWS credentials file.
+func AWSCredentialsPath() string {
+	return awsPath("AWS_SHARED_CREDENTIALS_FILE", "credentials")
+}
+
+// awsPath returns the file set in the environment like the AWS CLI does,
+// unless it is one of roller's own exported in isolated mode.
+func awsPath(env string, name string) string {
+	if p := os.Getenv(env); p != "" && p != path.Join(AppHomePath(), "aws", name) {
+		if strings.HasPrefix(p, "~/") {
+			p = path.Join(HomePath(), p[2:])
+		}
+		return p
+	}
+
+	return path.Join(HomePath(), ".aws", name)
 }
 
 func ReadProfiles() *Profiles {
-	cfg, err := ini.Load(path.Join(HomePath(), ".aws", "config"))
+	return readProfiles(ConfigPath())
+}
+
+// ReadAWSProfiles returns the profiles of the user's AWS config, which
+// differs from ReadProfiles in isolated mode.
+func ReadAWSProfiles() *Profiles {
+	return readProfiles(AWSConfigPath())
+}
+
+func readProfiles(path string) *Profiles {
+	cfg, base, err := loadIni(path)
 	ExitOnError(err)
 
-	profiles := NewProfiles(cfg)
+	profiles := NewProfiles(cfg, path)
+	profiles.base = base
 
 	for _, section := range cfg.Sections() {
 		profiles.Load(section)
@@ -151,11 +290,88 @@ func ReadProfiles() *Profiles {
 	return &profiles
 }
 
+// SessionsPath returns the path of the file roller keeps the sessions in
+// which are not written to the AWS credentials file.
+func SessionsPath() string {
+	if VaultBackend() {
+		return path.Join(AppHomePath(), "sessions"+vaultExtension)
+	}
+
+	return path.Join(AppHomePath(), "sessions")
+}
+
 func ReadCredentials() *Credentials {
-	cfg, err := ini.Load(path.Join(HomePath(), ".aws", "credentials"))
+	return readStore(CredentialsPath())
+}
+
+// ReadCredentialsFile reads the credentials file at path, like the one of
+// another roller process.
+func ReadCredentialsFile(path string) *Credentials {
+	return readStore(path)
+}
+
+// MFASessionsPath returns the path of the file the MFA authenticated
+// sessions of the source profiles are kept in.
+func MFASessionsPath() string {
+	if VaultBackend() {
+		return path.Join(AppHomePath(), "mfa_sessions"+vaultExtension)
+	}
+
+	return path.Join(AppHomePath(), "mfa_sessions")
+}
+
+// memorySessions are the sessions of the process without the vault.
+var memorySessions *Credentials
+
+// ReadSessions returns the sessions roller keeps for itself, like the ones
+// served to the AWS SDKs as a credential_process. Without the vault they are
+// only kept in memory, for as long as the process (like the agent) runs, so
+// their keys are never written in plaintext.
+func ReadSessions() *Credentials {
+	if VaultBackend() {
+		return readStore(SessionsPath())
+	}
+
+	if memorySessions == nil {
+		sessions := NewCredentials(ini.Empty(), "")
+		memorySessions = &sessions
+	}
+
+	return memorySessions
+}
+
+// MFASessionsInMemory tells whether the MFA sessions are only kept in memory,
+// which they are without the vault unless mfa_sessions_plaintext allows
+// writing them to disk in plaintext. The agent keeps them for the others then.
+func MFASessionsInMemory() bool {
+	return !VaultBackend() && !viper.GetBool("mfa_sessions_plaintext")
+}
+
+// memoryMFASessions are the MFA sessions of the process when they are only
+// kept in memory.
+var memoryMFASessions *Credentials
+
+// ReadMFASessions returns the MFA authenticated sessions by source profile.
+func ReadMFASessions() *Credentials {
+	if !MFASessionsInMemory() {
+		return readStore(MFASessionsPath())
+	}
+
+	if memoryMFASessions == nil {
+		sessions := NewCredentials(ini.Empty(), "")
+		memoryMFASessions = &sessions
+	}
+
+	return memoryMFASessions
+}
+
+// readStore reads a credentials file, which may not exist yet.
+func readStore(path string) *Credentials {
+	cfg, base, err := loadIni(path)
 	ExitOnError(err)
 
-	credentials := NewCredentials(cfg)
+	credentials := NewCredentials(cfg, path)
+	credentials.base = base
 
 	for _, section := range cfg.Sections() {
 		credentials.Load(section)
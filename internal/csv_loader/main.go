@@ -21,12 +21,12 @@
 package csv_loader
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
-	"os/user"
-	"path/filepath"
 	"strings"
 
 	"github.com/mitom/roller/pkg"
@@ -36,68 +36,74 @@ type loader string
 
 var Loader loader
 
-func main() {}
-func (l loader) Load(config *pkg.LoaderConfig) []pkg.LoadedProfile {
-	//get the current user for the home directory to support tilde~ paths
-	usr, err := user.Current()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(3)
+func (l loader) LoadContext(ctx context.Context, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	p, ok := config.GetOptions()["path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing the `path` attribute")
 	}
 
-	path := config.GetOptions()["path"].(string)
-
-	// handle home paths with tilde
-	if path[:2] == "~/" {
-		path = filepath.Join(usr.HomeDir, path[2:])
+	// support tilde~ and ..paths
+	path, err := pkg.ExpandPath(p)
+	if err != nil {
+		return nil, err
 	}
 
-	// run it through abspath to support ..paths
-	path, _ = filepath.Abs(path)
 	f, err := os.Open(path)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(3)
+		return nil, err
 	}
-	// read the file
-	r := csv.NewReader(f)
-	records, err := r.ReadAll()
+	defer f.Close()
+
+	return Parse(f, config)
+}
+
+// Parse reads the csv records from r and maps them with the loader options.
+func Parse(r io.Reader, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	records, err := csv.NewReader(r).ReadAll()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(3)
+		return nil, err
 	}
 
 	skipFirst := false
 	_, exists := config.GetOptions()["skip_first"]
 	if exists {
-		skipFirst = config.GetOptions()["skip_first"].(bool)
+		var ok bool
+		skipFirst, ok = config.GetOptions()["skip_first"].(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for skip_first: %v", config.GetOptions()["skip_first"])
+		}
 	}
 	_, exists = config.GetOptions()["mapping"]
 	var mapping []string
 	if !exists {
 		mapping = []string{"account_name", "account_id", "role", "ttl"}
 	} else {
-		var ok bool
-		mapping, ok = convertStringSlice(config.GetOptions()["mapping"].([]interface{}))
+		given, ok := config.GetOptions()["mapping"].([]interface{})
+		if ok {
+			mapping, ok = convertStringSlice(given)
+		}
 
 		if !ok {
-			fmt.Sprintf("%s is missing the `mapping` attribute", config.GetName())
-			os.Exit(3)
+			return nil, fmt.Errorf("invalid value for mapping: %v", config.GetOptions()["mapping"])
 		}
 	}
 
-	results := make([]pkg.LoadedProfile, len(records))
+	results := make([]pkg.LoadedProfile, 0, len(records))
 	for i, row := range records {
 		if i == 0 && skipFirst {
 			continue
 		}
-		results[i] = parseRow(row, mapping)
+		result, err := parseRow(row, mapping)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		results = append(results, result)
 	}
 
-	return results
+	return results, nil
 }
 
-func parseRow(row []string, mapping []string) pkg.LoadedProfile {
+func parseRow(row []string, mapping []string) (pkg.LoadedProfile, error) {
 	var result pkg.LoadedProfile
 	for k, cell := range row {
 		if k >= len(mapping) {
@@ -117,6 +123,31 @@ func parseRow(row []string, mapping []string) pkg.LoadedProfile {
 		case "ttl":
 			result.Parameters.TTL = strings.TrimSpace(cell)
 			break
+		case "description":
+			result.Description = strings.TrimSpace(cell)
+			break
+		case "region":
+			result.Region = strings.TrimSpace(cell)
+			break
+		case "owner":
+			result.Owner = strings.TrimSpace(cell)
+			break
+		case "external_id":
+			result.Parameters.ExternalID = strings.TrimSpace(cell)
+			break
+		case "policy_file":
+			result.Parameters.PolicyFile = strings.TrimSpace(cell)
+			break
+		case "policy_arns":
+			result.Parameters.PolicyArns = strings.Fields(cell)
+			break
+		case "via":
+			hops, err := pkg.ParseRoleHops(cell)
+			if err != nil {
+				return result, err
+			}
+			result.Parameters.Via = hops
+			break
 		case "switch_url":
 			parsed, _ := url.Parse(cell)
 			v, e := parsed.Query()["roleName"]
@@ -129,11 +160,14 @@ func parseRow(row []string, mapping []string) pkg.LoadedProfile {
 			}
 			break
 		default:
+			if strings.HasPrefix(mapping[k], "tag:") && strings.TrimSpace(cell) != "" {
+				result.SetTag(strings.TrimPrefix(mapping[k], "tag:"), strings.TrimSpace(cell))
+			}
 			continue
 
 		}
 	}
-	return result
+	return result, nil
 }
 
 func convertStringSlice(data []interface{}) ([]string, bool) {
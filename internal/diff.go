@@ -0,0 +1,240 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// the lines of unchanged context around the changes in a diff
+const diffContext = 3
+
+var secretLineRe = regexp.MustCompile(`(?m)^(\s*(?:aws_secret_access_key|aws_session_token)\s*=\s*)(\S.*)$`)
+
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// redactSecrets replaces the secrets in the ini text with a short hash of
+// them, so a diff still shows whether they changed.
+func redactSecrets(text string) string {
+	return secretLineRe.ReplaceAllStringFunc(text, func(line string) string {
+		match := secretLineRe.FindStringSubmatch(line)
+		sum := sha256.Sum256([]byte(match[2]))
+		return fmt.Sprintf("%s<redacted %x>", match[1], sum[:4])
+	})
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns the lines of both with the ones only in a marked with
+// '-' and the ones only in b with '+'.
+func diffLines(a []string, b []string) []diffLine {
+	// the changes are usually in a few sections, skip the rest
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] is the length of the longest common subsequence of ma[i:] and mb[j:]
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b))
+	for _, l := range a[:prefix] {
+		lines = append(lines, diffLine{' ', l})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			lines = append(lines, diffLine{' ', ma[i]})
+			i++
+			j++
+		case j < len(mb) && (i == len(ma) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, diffLine{'+', mb[j]})
+			j++
+		default:
+			lines = append(lines, diffLine{'-', ma[i]})
+			i++
+		}
+	}
+	for _, l := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', l})
+	}
+
+	return lines
+}
+
+// unifiedDiff returns the changes from old to new in the unified format,
+// empty if there are none.
+func unifiedDiff(name string, old string, new string) string {
+	lines := diffLines(splitLines(old), splitLines(new))
+
+	var out strings.Builder
+	oldLine, newLine := 1, 1
+	for start := 0; start < len(lines); {
+		first := start
+		for first < len(lines) && lines[first].kind == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		// a hunk goes on while the next change is close enough to share its context
+		last := first
+		for k := first; k < len(lines) && k-last <= 2*diffContext; k++ {
+			if lines[k].kind != ' ' {
+				last = k
+			}
+		}
+
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		to := last + diffContext + 1
+		if to > len(lines) {
+			to = len(lines)
+		}
+
+		// only unchanged lines are skipped
+		oldLine += from - start
+		newLine += from - start
+		oldCount, newCount := 0, 0
+		var hunk strings.Builder
+		for _, l := range lines[from:to] {
+			if l.kind != '+' {
+				oldCount++
+			}
+			if l.kind != '-' {
+				newCount++
+			}
+			hunk.WriteString(string(l.kind) + l.text + "\n")
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", name, name)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		out.WriteString(hunk.String())
+
+		oldLine += oldCount
+		newLine += newCount
+		start = to
+	}
+
+	return out.String()
+}
+
+func hunkRange(line int, count int) string {
+	if count == 0 {
+		// an empty range refers to the line before it
+		line--
+	}
+
+	return fmt.Sprintf("%d,%d", line, count)
+}
+
+// DryRun tells whether the changes to the AWS files are only to be shown.
+func DryRun() bool {
+	return viper.GetBool("dry_run")
+}
+
+// reviewed tells whether the changes to the file are reviewed before they
+// are written: those to the AWS files are, those to roller's own stores not.
+func reviewed(path string) bool {
+	return path == ConfigPath() || path == CredentialsPath()
+}
+
+// reviewing tells whether the changes to the AWS files are to be shown.
+func reviewing() bool {
+	return DryRun() || viper.GetBool("confirm")
+}
+
+// fileChange is what a file is and what it would be once written.
+type fileChange struct {
+	path string
+	old  string
+	new  string
+}
+
+// reviewChanges shows the changes to the files on stderr with --dry-run, or
+// when writes are to be confirmed, and tells whether to write them. They are
+// confirmed at once, not confirming them is an error as the command can not
+// go on.
+func reviewChanges(changes []fileChange) (bool, error) {
+	if DryRun() {
+		for _, c := range changes {
+			fmt.Fprint(os.Stderr, unifiedDiff(c.path, redactSecrets(c.old), redactSecrets(c.new)))
+		}
+		return false, nil
+	}
+
+	var paths []string
+	for _, c := range changes {
+		if diff := unifiedDiff(c.path, redactSecrets(c.old), redactSecrets(c.new)); diff != "" {
+			fmt.Fprint(os.Stderr, diff)
+			paths = append(paths, c.path)
+		}
+	}
+	if len(paths) == 0 || viper.GetBool("yes") {
+		return true, nil
+	}
+
+	answer := strings.ToLower(Prompt(fmt.Sprintf("Write the changes to %s? [y/N]", strings.Join(paths, " and "))))
+	if answer != "y" && answer != "yes" {
+		return false, fmt.Errorf("the changes to %s were not written", strings.Join(paths, " and "))
+	}
+
+	return true, nil
+}
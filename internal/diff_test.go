@@ -0,0 +1,169 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// numbered returns the numbers from first to last, one per line.
+func numbered(first int, last int) string {
+	var b strings.Builder
+	for i := first; i <= last; i++ {
+		b.WriteString(strconv.Itoa(i) + "\n")
+	}
+
+	return b.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old      string
+		new      string
+		expected string
+	}{
+		{
+			name:     "no changes",
+			old:      numbered(1, 10),
+			new:      numbered(1, 10),
+			expected: "",
+		},
+		{
+			name: "a line changed",
+			old:  numbered(1, 10),
+			new:  numbered(1, 4) + "five\n" + numbered(6, 10),
+			expected: `--- config
++++ config
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+`,
+		},
+		{
+			name: "changes far apart",
+			old:  numbered(1, 20),
+			new:  "1\ntwo\n" + numbered(3, 17) + "eighteen\n" + numbered(19, 20),
+			expected: `--- config
++++ config
+@@ -1,5 +1,5 @@
+ 1
+-2
++two
+ 3
+ 4
+ 5
+@@ -15,6 +15,6 @@
+ 15
+ 16
+ 17
+-18
++eighteen
+ 19
+ 20
+`,
+		},
+		{
+			name: "changes sharing their context",
+			old:  numbered(1, 10),
+			new:  "1\ntwo\n" + numbered(3, 7) + "eight\n" + numbered(9, 10),
+			expected: `--- config
++++ config
+@@ -1,10 +1,10 @@
+ 1
+-2
++two
+ 3
+ 4
+ 5
+ 6
+ 7
+-8
++eight
+ 9
+ 10
+`,
+		},
+		{
+			name: "lines added",
+			old:  numbered(1, 10),
+			new:  numbered(1, 10) + "11\n12\n",
+			expected: `--- config
++++ config
+@@ -8,3 +8,5 @@
+ 8
+ 9
+ 10
++11
++12
+`,
+		},
+		{
+			name: "the first line removed",
+			old:  numbered(1, 3),
+			new:  numbered(2, 3),
+			expected: `--- config
++++ config
+@@ -1,3 +1,2 @@
+-1
+ 2
+ 3
+`,
+		},
+		{
+			name: "an empty file written",
+			old:  "",
+			new:  numbered(1, 2),
+			expected: `--- config
++++ config
+@@ -0,0 +1,2 @@
++1
++2
+`,
+		},
+		{
+			name: "everything removed",
+			old:  numbered(1, 1),
+			new:  "",
+			expected: `--- config
++++ config
+@@ -1,1 +0,0 @@
+-1
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := unifiedDiff("config", test.old, test.new); diff != test.expected {
+				t.Fatalf("expected:\n%s\ngot:\n%s", test.expected, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package exec_loader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mitom/roller/pkg"
+)
+
+type loader string
+
+var Loader loader
+
+// Request is written to the stdin of the command.
+type Request struct {
+	Name    string                 `json:"name"`
+	Options map[string]interface{} `json:"options"`
+	TTL     int                    `json:"ttl"`
+}
+
+func (l loader) LoadContext(ctx context.Context, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	options := config.GetOptions()
+
+	command, ok := options["command"].(string)
+	if !ok || command == "" {
+		return nil, fmt.Errorf("missing the `command` attribute")
+	}
+	// only resolve paths, bare names are looked up on the PATH
+	if strings.ContainsRune(command, '/') {
+		var err error
+		command, err = pkg.ExpandPath(command)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var args []string
+	if given, ok := options["args"].([]interface{}); ok {
+		for _, a := range given {
+			args = append(args, fmt.Sprint(a))
+		}
+	}
+
+	timeout := 30 * time.Second
+	if t, ok := options["timeout"].(string); ok && t != "" {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for timeout: %s", err)
+		}
+	}
+
+	input, err := json.Marshal(Request{
+		Name:    config.GetName(),
+		Options: options,
+		TTL:     config.GetTtl(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", config.GetName(), line)
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s did not finish within %s", command, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s", command, err)
+	}
+
+	var results []pkg.LoadedProfile
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		return nil, fmt.Errorf("invalid output from %s: %s", command, err)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,76 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+const historyLimit = 50
+
+type HistoryEntry struct {
+	Name string
+	Time time.Time
+}
+
+func historyPath() string {
+	return path.Join(AppHomePath(), "history.json")
+}
+
+// ReadHistory returns the recently used roles, the most recent first.
+func ReadHistory() []HistoryEntry {
+	var history []HistoryEntry
+	read, err := ioutil.ReadFile(historyPath())
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(read, &history); err != nil {
+		Warn("can not read the history, ignoring it.")
+		return nil
+	}
+
+	return history
+}
+
+// RecordHistory moves the role to the top of the history.
+func RecordHistory(name string) {
+	err := WithLock(historyPath(), func() error {
+		history := []HistoryEntry{{name, time.Now()}}
+		for _, e := range ReadHistory() {
+			if e.Name != name && len(history) < historyLimit {
+				history = append(history, e)
+			}
+		}
+
+		serialised, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+
+		return writeFileAtomic(historyPath(), serialised)
+	})
+	if err != nil {
+		Warn("could not save the history: %s", err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package http_loader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitom/roller/internal/csv_loader"
+	"github.com/mitom/roller/internal/json_loader"
+	"github.com/mitom/roller/pkg"
+)
+
+type loader string
+
+var Loader loader
+
+func (l loader) LoadContext(ctx context.Context, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	results, _, _, err := l.LoadConditional(ctx, config, pkg.CacheValidators{})
+
+	return results, err
+}
+
+func (l loader) LoadConditional(ctx context.Context, config *pkg.LoaderConfig, validators pkg.CacheValidators) ([]pkg.LoadedProfile, pkg.CacheValidators, bool, error) {
+	options := config.GetOptions()
+
+	url, ok := options["url"].(string)
+	if !ok || url == "" {
+		return nil, validators, false, fmt.Errorf("missing the `url` attribute")
+	}
+
+	client, err := newClient(options)
+	if err != nil {
+		return nil, validators, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, validators, false, err
+	}
+
+	if headers, ok := options["headers"].(map[string]interface{}); ok {
+		for k, v := range headers {
+			req.Header.Set(k, fmt.Sprint(v))
+		}
+	}
+
+	if err := authenticate(req, options); err != nil {
+		return nil, validators, false, err
+	}
+
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, validators, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, validators, false, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, validators, false, fmt.Errorf("unexpected response from %s: %s", url, resp.Status)
+	}
+
+	updated := pkg.CacheValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	var results []pkg.LoadedProfile
+	switch format(options, resp) {
+	case "json":
+		results, err = json_loader.Parse(resp.Body, config)
+	case "csv":
+		results, err = csv_loader.Parse(resp.Body, config)
+	default:
+		err = fmt.Errorf("unsupported format: %s", format(options, resp))
+	}
+
+	if err != nil {
+		return nil, validators, false, err
+	}
+
+	return results, updated, true, nil
+}
+
+// format returns the configured format, falling back to the content type of
+// the response and then to csv.
+func format(options map[string]interface{}, resp *http.Response) string {
+	if f, ok := options["format"].(string); ok && f != "" {
+		return f
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if strings.HasSuffix(mediaType, "json") {
+		return "json"
+	}
+
+	return "csv"
+}
+
+func newClient(options map[string]interface{}) (*http.Client, error) {
+	timeout := 30 * time.Second
+	if t, ok := options["timeout"].(string); ok && t != "" {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for timeout: %s", err)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if bundle, ok := options["ca_bundle"].(string); ok && bundle != "" {
+		bundle, err := pkg.ExpandPath(bundle)
+		if err != nil {
+			return nil, err
+		}
+
+		pem, err := ioutil.ReadFile(bundle)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates could be read from %s", bundle)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// authenticate sets the Authorization header described by the `auth` option.
+// Secrets are never read from the config itself, only from the environment
+// or a file.
+func authenticate(req *http.Request, options map[string]interface{}) error {
+	auth, ok := options["auth"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	switch auth["type"] {
+	case "bearer":
+		token, err := secret(auth, "token")
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		username, _ := auth["username"].(string)
+		if env, ok := auth["username_env"].(string); ok {
+			username = os.Getenv(env)
+		}
+		password, err := secret(auth, "password")
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(username, password)
+	default:
+		return fmt.Errorf("invalid value for auth type: %v", auth["type"])
+	}
+
+	return nil
+}
+
+// secret reads the value of <name>_env or <name>_file from the auth options.
+func secret(auth map[string]interface{}, name string) (string, error) {
+	if env, ok := auth[name+"_env"].(string); ok {
+		value := os.Getenv(env)
+		if value == "" {
+			return "", fmt.Errorf("%s is not set", env)
+		}
+
+		return value, nil
+	}
+
+	if file, ok := auth[name+"_file"].(string); ok {
+		file, err := pkg.ExpandPath(file)
+		if err != nil {
+			return "", err
+		}
+
+		read, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(read)), nil
+	}
+
+	return "", fmt.Errorf("either %s_env or %s_file has to be set for auth", name, name)
+}
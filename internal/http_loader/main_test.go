@@ -0,0 +1,183 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package http_loader_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mitom/roller/internal"
+	"github.com/mitom/roller/internal/http_loader"
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/viper"
+)
+
+const roles = `[{"name": "prod", "account_id": "012345678901", "role": "Admin"}]`
+
+func TestNotModifiedIsServedFromTheCache(t *testing.T) {
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(roles))
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "roller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	viper.Set("cache_dir", cacheDir)
+	viper.Set("loader_timeout", "10s")
+	viper.Set("loader", map[string]interface{}{
+		"cmdb": map[string]interface{}{
+			"loader":  "http",
+			"options": map[string]interface{}{"url": server.URL},
+			"ttl":     3600,
+		},
+	})
+	defer viper.Reset()
+
+	internal.LoadCache()
+	assertLoaded(t)
+
+	cachePath := path.Join(cacheDir, "cmdb.json")
+	cache := readCache(t, cachePath)
+	if cache.Validators.ETag != `"v1"` {
+		t.Fatalf("expected the ETag to be cached, got %q", cache.Validators.ETag)
+	}
+
+	// expire the cache, so the next load asks the server again
+	cache.ValidUntil = time.Now().Add(-time.Minute)
+	serialised, err := json.Marshal(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cachePath, serialised, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	internal.LoadCache()
+	if requests != 2 || notModified != 1 {
+		t.Fatalf("expected a conditional request answered with 304, got %d requests, %d not modified", requests, notModified)
+	}
+	if len(internal.FailedLoaders) > 0 {
+		t.Fatalf("expected no failed loaders, got %v", internal.FailedLoaders)
+	}
+	assertLoaded(t)
+
+	cache = readCache(t, cachePath)
+	if !cache.ValidUntil.After(time.Now()) {
+		t.Fatalf("expected the cache to be valid again, it is valid until %s", cache.ValidUntil)
+	}
+	if cache.Validators.ETag != `"v1"` {
+		t.Fatalf("expected the ETag to be kept, got %q", cache.Validators.ETag)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	os.Setenv("ROLLER_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("ROLLER_TEST_TOKEN")
+
+	tests := []struct {
+		name     string
+		auth     map[string]interface{}
+		expected string
+	}{
+		{
+			name:     "bearer",
+			auth:     map[string]interface{}{"type": "bearer", "token_env": "ROLLER_TEST_TOKEN"},
+			expected: "Bearer s3cret",
+		},
+		{
+			name:     "basic",
+			auth:     map[string]interface{}{"type": "basic", "username": "roller", "password_env": "ROLLER_TEST_TOKEN"},
+			expected: "Basic cm9sbGVyOnMzY3JldA==",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var authorization string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization = r.Header.Get("Authorization")
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(roles))
+			}))
+			defer server.Close()
+
+			config := pkg.NewLoaderConfig("cmdb", "http", map[string]interface{}{"url": server.URL, "auth": test.auth}, 0)
+			loaded, err := http_loader.Loader.LoadContext(context.Background(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if authorization != test.expected {
+				t.Fatalf("expected the Authorization header %q, got %q", test.expected, authorization)
+			}
+			if len(loaded) != 1 {
+				t.Fatalf("expected 1 role, got %d", len(loaded))
+			}
+		})
+	}
+}
+
+func assertLoaded(t *testing.T) {
+	t.Helper()
+
+	p, ok := internal.AccountCache["prod/Admin"]
+	if !ok {
+		t.Fatalf("expected prod/Admin to be loaded, got %v", internal.AccountCache)
+	}
+	if p.Parameters.AccountID != "012345678901" {
+		t.Fatalf("expected the account 012345678901, got %s", p.Parameters.AccountID)
+	}
+}
+
+func readCache(t *testing.T, cachePath string) internal.SerialisedCache {
+	t.Helper()
+
+	read, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cache internal.SerialisedCache
+	if err := json.Unmarshal(read, &cache); err != nil {
+		t.Fatal(err)
+	}
+
+	return cache
+}
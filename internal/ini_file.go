@@ -0,0 +1,313 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// rawSection is a section of an ini file as it is written. The comments and
+// blank lines after its last key are kept apart, as they usually belong to
+// the section which follows.
+type rawSection struct {
+	name    string
+	content string
+	trailer string
+}
+
+// splitSections splits an ini file into its sections, the first of which
+// has no name and holds anything before the first section header.
+func splitSections(text string) []rawSection {
+	sections := []rawSection{{}}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.Contains(trimmed, "]") {
+			sections = append(sections, rawSection{name: strings.TrimSpace(trimmed[1:strings.Index(trimmed, "]")])})
+		}
+
+		s := &sections[len(sections)-1]
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			s.trailer += line
+		} else {
+			s.content += s.trailer + line
+			s.trailer = ""
+		}
+	}
+
+	return sections
+}
+
+// renderSection formats a section the way ini.v1 would.
+func renderSection(section *ini.Section) string {
+	f := ini.Empty()
+	target, _ := f.NewSection(section.Name())
+	for _, key := range section.Keys() {
+		k, _ := target.NewKey(key.Name(), key.Value())
+		k.Comment = key.Comment
+	}
+
+	var b bytes.Buffer
+	f.WriteTo(&b)
+
+	return strings.TrimRight(b.String(), "\n") + "\n"
+}
+
+// loadIni reads the ini file at path, which may not exist yet, along with
+// its sections as they were written, for saveIni to merge against.
+func loadIni(path string) (*ini.File, map[string]string, error) {
+	base := make(map[string]string)
+	raw, err := readIniFile(path)
+	if os.IsNotExist(err) {
+		return ini.Empty(), base, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := ini.Load(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range splitSections(string(raw)) {
+		base[s.name] += s.content
+	}
+
+	return data, base, nil
+}
+
+// iniFile is an ini file loaded to be changed and written back with the
+// changed sections, base being its sections as they were loaded.
+type iniFile struct {
+	data    *ini.File
+	path    string
+	changed map[string]bool
+	base    map[string]string
+}
+
+func newIniFile(data *ini.File, path string) iniFile {
+	return iniFile{data, path, make(map[string]bool), make(map[string]string)}
+}
+
+func (f iniFile) file() iniFile {
+	return f
+}
+
+// saveIni writes the changed sections of the files and leaves every other
+// byte of them as it was. Sections are rewritten in place, removed when they
+// no longer exist in the data or appended when they are new. Files without a
+// path are only kept in memory.
+//
+// The changes to the AWS files are reviewed first, all at once and without
+// holding the locks, so other rollers are not held up while waiting for an
+// answer. Nothing is written on a dry run. Each file is then read again while
+// holding its lock, so the changes are merged with what other processes wrote
+// since it was loaded: a section deleted here which was changed by another
+// process since (compared to base) is kept.
+func saveIni(files ...iniFile) error {
+	var changes []fileChange
+	for i := range files {
+		if files[i].path == "" {
+			continue
+		}
+
+		review := reviewed(files[i].path)
+		if resolved, err := filepath.EvalSymlinks(files[i].path); err == nil {
+			files[i].path = resolved
+		}
+		if !review || !reviewing() {
+			continue
+		}
+
+		existing, err := readIniFile(files[i].path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		merged := mergeIni(string(existing), files[i].data, files[i].changed, files[i].base)
+		changes = append(changes, fileChange{files[i].path, string(existing), merged})
+	}
+	if write, err := reviewChanges(changes); !write {
+		return err
+	}
+
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+
+		err := WithLock(f.path, func() error {
+			existing, err := readIniFile(f.path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			merged := []byte(mergeIni(string(existing), f.data, f.changed, f.base))
+			if existing != nil && bytes.Equal(merged, existing) {
+				return nil
+			}
+			if isVault(f.path) {
+				if merged, err = sealVault(merged); err != nil {
+					return err
+				}
+			}
+
+			return writeFileAtomic(f.path, merged)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readIniFile reads an ini file, decrypting it if it is a vault.
+func readIniFile(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil || !isVault(path) {
+		return raw, err
+	}
+
+	return openVault(raw)
+}
+
+// mergeIni returns the existing text with the changed sections of data
+// written over it.
+func mergeIni(existing string, data *ini.File, changed map[string]bool, base map[string]string) string {
+	current := make(map[string]string)
+	for _, s := range splitSections(existing) {
+		current[s.name] += s.content
+	}
+
+	var out strings.Builder
+	written := make(map[string]bool)
+	// whether the last section was removed
+	removedLast := false
+	for _, s := range splitSections(existing) {
+		section, err := data.GetSection(s.name)
+		deleted := err != nil
+		if s.name == "" || !changed[s.name] || (deleted && current[s.name] != base[s.name]) {
+			out.WriteString(s.content + s.trailer)
+			removedLast = false
+			continue
+		}
+
+		trailer := s.trailer
+		if !deleted && !written[s.name] {
+			out.WriteString(renderSection(section))
+			removedLast = false
+		} else {
+			if !endsWithKey(out.String()) {
+				// the blank lines separated the removed section
+				trailer = strings.TrimLeft(trailer, " \t\r\n")
+			}
+			removedLast = true
+		}
+		written[s.name] = true
+		out.WriteString(trailer)
+	}
+	if removedLast {
+		// nothing follows the blank lines before the removed section
+		text := trimBlankLines(out.String())
+		out.Reset()
+		out.WriteString(text)
+	}
+
+	for _, name := range data.SectionStrings() {
+		if !changed[name] || written[name] {
+			continue
+		}
+
+		text := out.String()
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			out.WriteString("\n")
+		}
+		if text != "" && !strings.HasSuffix(text, "\n\n") {
+			out.WriteString("\n")
+		}
+		out.WriteString(renderSection(data.Section(name)))
+	}
+
+	return out.String()
+}
+
+// endsWithKey tells whether the last line of the ini text is a key rather
+// than a blank line or a comment.
+func endsWithKey(text string) bool {
+	text = strings.TrimSuffix(text, "\n")
+	line := strings.TrimSpace(text[strings.LastIndex(text, "\n")+1:])
+
+	return line != "" && line[0] != '#' && line[0] != ';'
+}
+
+// trimBlankLines removes the blank lines at the end of the text.
+func trimBlankLines(text string) string {
+	for strings.HasSuffix(text, "\n") {
+		i := strings.LastIndex(text[:len(text)-1], "\n")
+		if strings.TrimSpace(text[i+1:]) != "" {
+			break
+		}
+		text = text[:i+1]
+	}
+
+	return text
+}
+
+// writeFileAtomic replaces the file through a temporary one, so it is
+// never left half written. The file is only readable by the user.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
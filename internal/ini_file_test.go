@@ -0,0 +1,190 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+const mergeIniExisting = `# written by hand
+[default]
+region = eu-west-1
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region    = eu-west-1
+
+# the roles
+[profile a]
+roller = true
+region = eu-west-1
+
+[profile b]
+roller = true
+region = eu-west-2
+`
+
+func TestMergeIni(t *testing.T) {
+	tests := []struct {
+		name string
+		// base replaces the sections as they were loaded
+		base     map[string]string
+		change   func(data *ini.File) []string
+		expected string
+	}{
+		{
+			name: "nothing changed",
+			change: func(data *ini.File) []string {
+				return nil
+			},
+			expected: mergeIniExisting,
+		},
+		{
+			name: "a section updated",
+			change: func(data *ini.File) []string {
+				data.Section("profile a").Key("region").SetValue("us-east-1")
+				return []string{"profile a"}
+			},
+			expected: `# written by hand
+[default]
+region = eu-west-1
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region    = eu-west-1
+
+# the roles
+[profile a]
+roller = true
+region = us-east-1
+
+[profile b]
+roller = true
+region = eu-west-2
+`,
+		},
+		{
+			name: "a section deleted",
+			change: func(data *ini.File) []string {
+				data.DeleteSection("profile a")
+				return []string{"profile a"}
+			},
+			expected: `# written by hand
+[default]
+region = eu-west-1
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region    = eu-west-1
+
+# the roles
+[profile b]
+roller = true
+region = eu-west-2
+`,
+		},
+		{
+			name: "the last section deleted",
+			change: func(data *ini.File) []string {
+				data.DeleteSection("profile b")
+				return []string{"profile b"}
+			},
+			expected: `# written by hand
+[default]
+region = eu-west-1
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region    = eu-west-1
+
+# the roles
+[profile a]
+roller = true
+region = eu-west-1
+`,
+		},
+		{
+			name: "every roller section deleted",
+			change: func(data *ini.File) []string {
+				data.DeleteSection("profile a")
+				data.DeleteSection("profile b")
+				return []string{"profile a", "profile b"}
+			},
+			expected: `# written by hand
+[default]
+region = eu-west-1
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region    = eu-west-1
+
+# the roles
+`,
+		},
+		{
+			name: "a section changed by another process kept",
+			base: map[string]string{"profile a": "[profile a]\nroller = true\n"},
+			change: func(data *ini.File) []string {
+				data.DeleteSection("profile a")
+				return []string{"profile a"}
+			},
+			expected: mergeIniExisting,
+		},
+		{
+			name: "a section added",
+			change: func(data *ini.File) []string {
+				data.Section("profile c").NewKey("roller", "true")
+				return []string{"profile c"}
+			},
+			expected: mergeIniExisting + `
+[profile c]
+roller = true
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := ini.Load([]byte(mergeIniExisting))
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := make(map[string]string)
+			for _, s := range splitSections(mergeIniExisting) {
+				base[s.name] += s.content
+			}
+			for name, content := range test.base {
+				base[name] = content
+			}
+
+			changed := make(map[string]bool)
+			for _, name := range test.change(data) {
+				changed[name] = true
+			}
+
+			if merged := mergeIni(mergeIniExisting, data, changed, base); merged != test.expected {
+				t.Fatalf("expected:\n%s\ngot:\n%s", test.expected, merged)
+			}
+		})
+	}
+}
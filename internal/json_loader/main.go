@@ -0,0 +1,371 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package json_loader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitom/roller/pkg"
+)
+
+type loader string
+
+var Loader loader
+
+var defaultMapping = map[string]interface{}{
+	"account_name": "name",
+	"account_id":   "account_id",
+	"role":         "role",
+	"ttl":          "ttl",
+	"from_profile": "from_profile",
+	"via":          "via",
+}
+
+func (l loader) LoadContext(ctx context.Context, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	path, ok := config.GetOptions()["path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing the `path` attribute")
+	}
+
+	path, err := pkg.ExpandPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f, config)
+}
+
+// Parse decodes the JSON document from r and maps it with the loader options.
+func Parse(r io.Reader, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	var document interface{}
+	decoder := json.NewDecoder(r)
+	// keep account IDs as they were written rather than as floats
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	return Extract(document, config)
+}
+
+// Extract maps a decoded JSON-like document onto profiles.
+//
+// The `root` option points at the records (an array or a single object) and
+// every value in `mapping` is a dot separated path relative to a record. A
+// path segment ending in `[]` iterates an array, producing one profile per
+// element, so `roles[].name` yields a profile for each role of an account.
+func Extract(document interface{}, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	options := config.GetOptions()
+
+	root := document
+	if r, ok := options["root"].(string); ok && r != "" {
+		for _, segment := range strings.Split(r, ".") {
+			root = lookup(root, segment)
+		}
+	}
+
+	givenMapping, ok := options["mapping"]
+	if !ok {
+		givenMapping = defaultMapping
+	}
+	mapping, ok := givenMapping.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid value for mapping: %v", givenMapping)
+	}
+
+	fields := make(map[string][]string, len(mapping))
+	for field, p := range mapping {
+		ps, ok := p.(string)
+		if !ok || ps == "" {
+			return nil, fmt.Errorf("invalid path for %s: %v", field, p)
+		}
+		fields[field] = strings.Split(ps, ".")
+	}
+
+	var records []interface{}
+	switch r := root.(type) {
+	case []interface{}:
+		records = r
+	case map[string]interface{}:
+		records = []interface{}{r}
+	case nil:
+		return nil, fmt.Errorf("the root %v does not exist", options["root"])
+	default:
+		return nil, fmt.Errorf("the root must be an array or an object, got %T", root)
+	}
+
+	var results []pkg.LoadedProfile
+	for _, record := range records {
+		rows, err := expand(record, fields)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			result, err := parseRow(row)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+func parseRow(row map[string]string) (pkg.LoadedProfile, error) {
+	var result pkg.LoadedProfile
+	for field, value := range row {
+		switch field {
+		case "account_name":
+			result.Name = value
+		case "account_id":
+			result.Parameters.AccountID = value
+		case "role":
+			result.Parameters.Role = value
+		case "ttl":
+			result.Parameters.TTL = value
+		case "from_profile":
+			result.Parameters.FromProfile = value
+		case "description":
+			result.Description = value
+		case "region":
+			result.Region = value
+		case "owner":
+			result.Owner = value
+		case "external_id":
+			result.Parameters.ExternalID = value
+		case "policy_file":
+			result.Parameters.PolicyFile = value
+		case "policy_arns":
+			result.Parameters.PolicyArns = strings.Fields(value)
+		case "via":
+			hops, err := pkg.ParseRoleHops(value)
+			if err != nil {
+				return result, err
+			}
+			result.Parameters.Via = hops
+		default:
+			if strings.HasPrefix(field, "tag:") && value != "" {
+				result.SetTag(strings.TrimPrefix(field, "tag:"), value)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// roleHops formats a list of hops, given either in their textual form or as
+// objects with an account_id, role and external_id.
+func roleHops(values []interface{}) (string, error) {
+	hops := make([]pkg.RoleHop, 0, len(values))
+	for _, v := range values {
+		switch hop := v.(type) {
+		case string:
+			parsed, err := pkg.ParseRoleHops(hop)
+			if err != nil {
+				return "", err
+			}
+			hops = append(hops, parsed...)
+		case map[string]interface{}:
+			var fields [3]string
+			for i, key := range []string{"account_id", "role", "external_id"} {
+				s, err := scalar(hop[key])
+				if err != nil {
+					return "", fmt.Errorf("%s: %s", key, err)
+				}
+				fields[i] = s
+			}
+			if fields[0] == "" || fields[1] == "" {
+				return "", fmt.Errorf("a role hop needs an account_id and a role")
+			}
+			hops = append(hops, pkg.RoleHop{AccountID: fields[0], Role: fields[1], ExternalID: fields[2]})
+		default:
+			return "", fmt.Errorf("expected a role hop, got %T", v)
+		}
+	}
+
+	return pkg.FormatRoleHops(hops), nil
+}
+
+// expand resolves the paths in fields against node. Fields that share the
+// same array prefix are iterated together, while independent arrays are
+// combined with each other.
+func expand(node interface{}, fields map[string][]string) ([]map[string]string, error) {
+	row := make(map[string]string)
+	groups := make(map[string]map[string][]string)
+
+	for field, segments := range fields {
+		value := node
+		grouped := false
+		for i, segment := range segments {
+			if strings.HasSuffix(segment, "[]") {
+				prefix := strings.Join(segments[:i+1], ".")
+				if groups[prefix] == nil {
+					groups[prefix] = make(map[string][]string)
+				}
+				groups[prefix][field] = segments[i+1:]
+				grouped = true
+				break
+			}
+			value = lookup(value, segment)
+		}
+
+		if grouped {
+			continue
+		}
+
+		// an object mapped to tags provides all of its keys as tags
+		if m, ok := value.(map[string]interface{}); ok && field == "tags" {
+			for k, v := range m {
+				s, err := scalar(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %s", strings.Join(segments, "."), k, err)
+				}
+				row["tag:"+k] = s
+			}
+			continue
+		}
+
+		// a list of hops mapped to via is kept in its textual form
+		if a, ok := value.([]interface{}); ok && field == "via" {
+			s, err := roleHops(a)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", strings.Join(segments, "."), err)
+			}
+			row[field] = s
+			continue
+		}
+
+		// a list of policy ARNs is kept separated by spaces
+		if a, ok := value.([]interface{}); ok && field == "policy_arns" {
+			arns := make([]string, len(a))
+			for i, v := range a {
+				s, err := scalar(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", strings.Join(segments, "."), err)
+				}
+				arns[i] = s
+			}
+			row[field] = strings.Join(arns, " ")
+			continue
+		}
+
+		s, err := scalar(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", strings.Join(segments, "."), err)
+		}
+		row[field] = s
+	}
+
+	prefixes := make([]string, 0, len(groups))
+	for prefix := range groups {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	rows := []map[string]string{row}
+	for _, prefix := range prefixes {
+		value := node
+		segments := strings.Split(strings.TrimSuffix(prefix, "[]"), ".")
+		for _, segment := range segments {
+			value = lookup(value, segment)
+		}
+
+		var elements []interface{}
+		switch v := value.(type) {
+		case []interface{}:
+			elements = v
+		case nil:
+		default:
+			return nil, fmt.Errorf("%s: expected an array, got %T", prefix, value)
+		}
+
+		var expanded []map[string]string
+		for _, element := range elements {
+			sub, err := expand(element, groups[prefix])
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, sub...)
+		}
+
+		var combined []map[string]string
+		for _, r := range rows {
+			for _, e := range expanded {
+				m := make(map[string]string, len(r)+len(e))
+				for k, v := range r {
+					m[k] = v
+				}
+				for k, v := range e {
+					m[k] = v
+				}
+				combined = append(combined, m)
+			}
+		}
+		rows = combined
+	}
+
+	return rows, nil
+}
+
+func lookup(value interface{}, segment string) interface{} {
+	if segment == "" {
+		return value
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	return m[segment]
+}
+
+func scalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return strings.TrimSpace(v), nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int, int64, uint64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("expected a scalar value, got %T", value)
+	}
+}
@@ -21,118 +21,128 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
-	"plugin"
 	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/mitom/roller/internal/csv_loader"
+	"github.com/mitom/roller/internal/exec_loader"
+	"github.com/mitom/roller/internal/http_loader"
+	"github.com/mitom/roller/internal/json_loader"
+	"github.com/mitom/roller/internal/yaml_loader"
 	"github.com/mitom/roller/pkg"
 
 	"github.com/spf13/viper"
 )
 
 var AccountCache map[string]*pkg.LoadedProfile
+
+// FailedLoaders are the names of the loaders which failed to load their
+// roles, so AccountCache may be missing some of theirs.
+var FailedLoaders []string
 var nameReplaceRe = regexp.MustCompile(`[^\d\w\-]`)
 
 type SerialisedCache struct {
 	ValidUntil time.Time
 	Data       *[]pkg.LoadedProfile
+	Validators pkg.CacheValidators
 }
 
-func createLoaderConfig(name string, givenConfig interface{}) *pkg.LoaderConfig {
-	cf := givenConfig.(map[string]interface{})
+func createLoaderConfig(name string, givenConfig interface{}) (*pkg.LoaderConfig, error) {
+	cf, ok := givenConfig.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid config for %s: %v", name, givenConfig)
+	}
 
 	loader, ok := cf["loader"].(string)
 	if !ok {
-		ExitWithError(fmt.Sprintf("Invalid value for loader: %s", cf["loader"]), 1)
+		return nil, fmt.Errorf("invalid value for loader in %s: %v", name, cf["loader"])
 	}
 	options, ok := cf["options"].(map[string]interface{})
 	if !ok {
-		ExitWithError(fmt.Sprintf("Invalid value for options: %s", cf["options"]), 1)
+		return nil, fmt.Errorf("invalid value for options in %s: %v", name, cf["options"])
 	}
 	ttl, ok := cf["ttl"].(int)
 	if !ok {
-		ExitWithError(fmt.Sprintf("Invalid value for ttl: %s", cf["ttl"]), 1)
+		return nil, fmt.Errorf("invalid value for ttl in %s: %v", name, cf["ttl"])
 	}
 
-	return pkg.NewLoaderConfig(name, loader, options, ttl)
+	return pkg.NewLoaderConfig(name, loader, options, ttl), nil
 }
 
 func ClearCache() {
 	os.RemoveAll(path.Join(viper.GetString("cache_dir")))
 }
 
+// LoaderConfigs returns the configured loaders ordered by name. Invalid
+// configs are reported and left out.
+func LoaderConfigs() []*pkg.LoaderConfig {
+	configs := viper.GetStringMap("loader")
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]*pkg.LoaderConfig, 0, len(names))
+	for _, name := range names {
+		cfg, err := createLoaderConfig(name, configs[name])
+		if err != nil {
+			Warn("%s", err)
+			continue
+		}
+		results = append(results, cfg)
+	}
+
+	return results
+}
+
+// BuiltinLoader returns the loader shipped with roller by the given name,
+// or nil if it has to be loaded from the plugin_dir.
+func BuiltinLoader(name string) pkg.LoaderV2 {
+	switch name {
+	case "csv":
+		return csv_loader.Loader
+	case "json":
+		return json_loader.Loader
+	case "yaml":
+		return yaml_loader.Loader
+	case "http":
+		return http_loader.Loader
+	case "exec":
+		return exec_loader.Loader
+	}
+
+	return nil
+}
+
+// LoadCache loads the roles of every loader into AccountCache. A failing
+// loader is reported and skipped, so the roles of the others stay available.
 func LoadCache() {
+	defer ClosePlugins()
+
 	results := make(map[string]*pkg.LoadedProfile)
-	givenConfig := viper.Get("loader")
-	configs := givenConfig.(map[string]interface{})
-	now := time.Now()
+	FailedLoaders = nil
 	os.Mkdir(viper.GetString("cache_dir"), 0700)
-	for cacheName, c := range configs {
-		cfg := createLoaderConfig(cacheName, c)
-		var loaded *[]pkg.LoadedProfile
-		if cfg.GetTtl() > 0 {
-			read, _ := ioutil.ReadFile(path.Join(viper.GetString("cache_dir"), cfg.GetName()+".json"))
-			if read != nil {
-				var serialised SerialisedCache
-				if err := json.Unmarshal(read, &serialised); err != nil {
-					fmt.Printf("Warning: can not read the cache for %s, ignoring it.\n", cfg.GetName())
-				} else if serialised.ValidUntil.After(now) {
-					loaded = serialised.Data
-				}
-			}
-		}
-		if loaded == nil {
-			var loader pkg.Loader
-			if cfg.GetLoader() == "csv" {
-				loader = csv_loader.Loader
-			} else {
-				pluginPath := viper.GetString("plugin_dir")
-
-				modulePath := path.Join(pluginPath, cfg.GetLoader())
-				plug, err := plugin.Open(modulePath)
-				ExitOnError(err)
-
-				// LoadCache the module
-				symLoader, err := plug.Lookup("Loader")
-				ExitOnError(err)
-
-				// Assert that the interface is implemented
-				var ok bool
-				loader, ok = symLoader.(pkg.Loader)
-				if !ok {
-					ExitWithError(fmt.Sprintf("%s is either outdated or invalid! Make sure it implements the proper interface.\n", pluginPath), 1)
-				}
-			}
-
-			l := loader.Load(cfg)
-			loaded = &l
-
-			if cfg.GetTtl() > 0 {
-				expiration := now.Add(time.Duration(cfg.GetTtl()) * time.Second)
-				toSerialise := SerialisedCache{
-					expiration,
-					loaded,
-				}
-				serialised, err := json.Marshal(toSerialise)
-				if err != nil {
-					fmt.Printf("Warning: could not serialise %s, can not cache it.", cfg.GetName())
-					fmt.Println(err)
-				}
-
-				err = ioutil.WriteFile(path.Join(viper.GetString("cache_dir"), cfg.GetName()+".json"), serialised, 0600)
-				if err != nil {
-					fmt.Println(err)
-				}
+	for _, cfg := range LoaderConfigs() {
+		loaded, err := loadProfiles(cfg)
+		if err != nil {
+			FailedLoaders = append(FailedLoaders, cfg.GetName())
+			if loaded == nil {
+				Warn("the %s loader failed: %s", cfg.GetName(), err)
+				continue
 			}
+			Warn("the %s loader failed, using its expired cache: %s", cfg.GetName(), err)
 		}
 
-		for _, r := range *loaded {
+		for _, r := range loaded {
 			if !r.Parameters.Valid() {
 				continue
 			}
@@ -149,6 +159,7 @@ func LoadCache() {
 			} else {
 				//make a copy of the account as range reuses the memory for r
 				m := r
+				m.Source = cfg.GetName()
 				results[name] = &m
 			}
 		}
@@ -156,3 +167,110 @@ func LoadCache() {
 
 	AccountCache = results
 }
+
+// loadProfiles returns the roles of a loader, from the cache while it is
+// valid. When the loader fails, its expired cache is returned along with the
+// error if there is one.
+func loadProfiles(cfg *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	now := time.Now()
+	cachePath := path.Join(viper.GetString("cache_dir"), cfg.GetName()+".json")
+
+	var stale *SerialisedCache
+	if cfg.GetTtl() > 0 {
+		read, _ := ioutil.ReadFile(cachePath)
+		if read != nil {
+			var serialised SerialisedCache
+			if err := json.Unmarshal(read, &serialised); err != nil {
+				Warn("can not read the cache for %s, ignoring it.", cfg.GetName())
+			} else if serialised.Data != nil && serialised.ValidUntil.After(now) {
+				return *serialised.Data, nil
+			} else if serialised.Data != nil {
+				stale = &serialised
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("loader_timeout"))
+	defer cancel()
+
+	loaded, validators, err := runLoader(ctx, cfg, stale)
+	if err != nil {
+		if stale == nil {
+			return nil, err
+		}
+
+		return *stale.Data, err
+	}
+
+	if cfg.GetTtl() > 0 {
+		expiration := now.Add(time.Duration(cfg.GetTtl()) * time.Second)
+		toSerialise := SerialisedCache{
+			expiration,
+			&loaded,
+			validators,
+		}
+		serialised, err := json.Marshal(toSerialise)
+		if err != nil {
+			Warn("could not serialise %s, can not cache it: %s", cfg.GetName(), err)
+			return loaded, nil
+		}
+
+		err = WithLock(cachePath, func() error {
+			return writeFileAtomic(cachePath, serialised)
+		})
+		if err != nil {
+			Warn("%s", err)
+		}
+	}
+
+	return loaded, nil
+}
+
+func runLoader(ctx context.Context, cfg *pkg.LoaderConfig, stale *SerialisedCache) ([]pkg.LoadedProfile, pkg.CacheValidators, error) {
+	var validators pkg.CacheValidators
+
+	loader := BuiltinLoader(cfg.GetLoader())
+	if loader == nil {
+		plug, err := OpenPlugin(cfg.GetLoader())
+		if err != nil {
+			return nil, validators, err
+		}
+
+		if plug.Has(pkg.CapabilityValidate) {
+			errs, err := plug.Validate(ctx, cfg)
+			if err != nil {
+				return nil, validators, err
+			}
+			if len(errs) > 0 {
+				return nil, validators, fmt.Errorf("invalid config: %s", strings.Join(errs, ", "))
+			}
+		}
+
+		if stale != nil && plug.Has(pkg.CapabilityRefresh) {
+			loaded, err := plug.Refresh(ctx, cfg, *stale.Data)
+			return loaded, validators, err
+		}
+		loader = plug
+	}
+
+	if conditional, ok := loader.(pkg.ConditionalLoader); ok && cfg.GetTtl() > 0 {
+		var previous pkg.CacheValidators
+		if stale != nil {
+			previous = stale.Validators
+		}
+
+		loaded, updated, modified, err := conditional.LoadConditional(ctx, cfg, previous)
+		if err != nil {
+			return nil, validators, err
+		}
+		if !modified && stale != nil {
+			return *stale.Data, updated, nil
+		}
+
+		return loaded, updated, nil
+	}
+
+	loaded, err := loader.LoadContext(ctx, cfg)
+
+	return loaded, validators, err
+}
@@ -0,0 +1,56 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"path/filepath"
+	"regexp"
+)
+
+var lockNameRe = regexp.MustCompile(`[^\w.-]`)
+
+// lockPath returns the path of the lock of a file, which is kept under
+// roller's home rather than next to the file.
+func lockPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	return filepath.Join(AppHomePath(), "locks", lockNameRe.ReplaceAllString(path, "_")+".lock")
+}
+
+// WithLock runs f while holding an advisory lock on the file, so other roller
+// processes can not change it in the meantime. It waits for the lock if
+// another process, or another goroutine of this one, has it. The lock is
+// taken for this call only and is not reentrant: f must not lock the same
+// file again.
+func WithLock(path string, f func() error) error {
+	unlock, err := lockFile(lockPath(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return f()
+}
@@ -0,0 +1,286 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package picker
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const previewHeight = 8
+
+type Item struct {
+	// Value is returned when the item is picked.
+	Value string
+	// Label is the line shown in the list, it is also what the query matches.
+	Label string
+	// Preview is shown below the list while the item is highlighted.
+	Preview []string
+	// Recent items are listed first, in their given order.
+	Recent bool
+}
+
+type match struct {
+	item  *Item
+	score int
+	index int
+}
+
+type picker struct {
+	tty      *os.File
+	items    []Item
+	query    []rune
+	matches  []match
+	selected int
+	offset   int
+}
+
+// Run draws a full screen fuzzy finder on the terminal and returns the value
+// of the picked item. It uses /dev/tty rather than stdin/stdout, so it works
+// while the output of roller is captured by the shell wrapper. The returned
+// value is empty if the user cancelled.
+func Run(items []Item) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	state, err := term.MakeRaw(int(tty.Fd()))
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(int(tty.Fd()), state)
+
+	// switch to the alternate screen and hide the cursor
+	fmt.Fprint(tty, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(tty, "\x1b[?25h\x1b[?1049l")
+
+	p := &picker{tty: tty, items: items}
+	p.filter()
+
+	buf := make([]byte, 64)
+	for {
+		p.draw()
+
+		n, err := tty.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		switch key := string(buf[:n]); key {
+		case "\r", "\n":
+			if len(p.matches) == 0 {
+				continue
+			}
+			return p.matches[p.selected].item.Value, nil
+		case "\x03", "\x1b", "\x07":
+			return "", nil
+		case "\x1b[A", "\x1bOA", "\x10", "\x0b":
+			p.move(-1)
+		case "\x1b[B", "\x1bOB", "\x0e":
+			p.move(1)
+		case "\x1b[5~":
+			p.move(-p.listHeight())
+		case "\x1b[6~":
+			p.move(p.listHeight())
+		case "\x7f", "\x08":
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.filter()
+			}
+		case "\x15":
+			p.query = nil
+			p.filter()
+		default:
+			if strings.HasPrefix(key, "\x1b") {
+				continue
+			}
+			for len(key) > 0 {
+				r, size := utf8.DecodeRuneInString(key)
+				key = key[size:]
+				if unicode.IsPrint(r) {
+					p.query = append(p.query, r)
+				}
+			}
+			p.filter()
+		}
+	}
+}
+
+func (p *picker) size() (int, int) {
+	width, height, err := term.GetSize(int(p.tty.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+
+	return width, height
+}
+
+func (p *picker) listHeight() int {
+	_, height := p.size()
+	// prompt, counter and the preview with its separator
+	h := height - 3 - previewHeight
+	if h < 1 {
+		return 1
+	}
+
+	return h
+}
+
+func (p *picker) move(delta int) {
+	p.selected += delta
+	if p.selected >= len(p.matches) {
+		p.selected = len(p.matches) - 1
+	}
+	if p.selected < 0 {
+		p.selected = 0
+	}
+}
+
+func (p *picker) filter() {
+	query := strings.ToLower(string(p.query))
+	p.matches = p.matches[:0]
+	for i := range p.items {
+		score, ok := fuzzyScore(strings.ToLower(p.items[i].Label), query)
+		if !ok {
+			continue
+		}
+		p.matches = append(p.matches, match{&p.items[i], score, i})
+	}
+
+	sort.SliceStable(p.matches, func(i, j int) bool {
+		a, b := p.matches[i], p.matches[j]
+		if a.score != b.score && query != "" {
+			return a.score > b.score
+		}
+		if a.item.Recent != b.item.Recent {
+			return a.item.Recent
+		}
+
+		return a.index < b.index
+	})
+
+	p.selected = 0
+	p.offset = 0
+}
+
+func (p *picker) draw() {
+	width, _ := p.size()
+	height := p.listHeight()
+
+	if p.selected < p.offset {
+		p.offset = p.selected
+	}
+	if p.selected >= p.offset+height {
+		p.offset = p.selected - height + 1
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "> %s\r\n", string(p.query))
+	fmt.Fprintf(&b, "\x1b[2m  %d/%d\x1b[0m\r\n", len(p.matches), len(p.items))
+
+	for i := 0; i < height; i++ {
+		index := p.offset + i
+		if index < len(p.matches) {
+			item := p.matches[index].item
+			line := truncate(item.Label, width-2)
+			if index == p.selected {
+				fmt.Fprintf(&b, "\x1b[7m> %s\x1b[0m", line)
+			} else if item.Recent {
+				fmt.Fprintf(&b, "\x1b[1m  %s\x1b[0m", line)
+			} else {
+				fmt.Fprintf(&b, "  %s", line)
+			}
+		}
+		b.WriteString("\r\n")
+	}
+
+	b.WriteString("\x1b[2m" + strings.Repeat("─", width) + "\x1b[0m\r\n")
+	if len(p.matches) > 0 {
+		preview := p.matches[p.selected].item.Preview
+		for i := 0; i < previewHeight && i < len(preview); i++ {
+			b.WriteString(truncate(preview[i], width) + "\r\n")
+		}
+	}
+
+	fmt.Fprint(p.tty, b.String())
+}
+
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+
+	return string(runes[:width-1]) + "…"
+}
+
+// fuzzyScore tells whether the characters of query appear in order in s,
+// rewarding consecutive characters and ones at the start of a word.
+func fuzzyScore(s string, query string) (int, bool) {
+	if query == "" {
+		return 0, true
+	}
+
+	score := 0
+	consecutive := 0
+	last := -1
+	qi := 0
+	q := []rune(query)
+	runes := []rune(s)
+	for i, r := range runes {
+		if qi == len(q) {
+			break
+		}
+		if r != q[qi] {
+			consecutive = 0
+			continue
+		}
+
+		score++
+		if last == i-1 {
+			consecutive++
+			score += consecutive * 2
+		}
+		if i == 0 || strings.ContainsRune(" /-_.:", runes[i-1]) {
+			score += 3
+		}
+		last = i
+		qi++
+	}
+
+	if qi < len(q) {
+		return 0, false
+	}
+
+	return score, true
+}
@@ -0,0 +1,398 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"debug/elf"
+	"debug/macho"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"plugin"
+	"time"
+
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/viper"
+)
+
+// supportedAPIVersions lists the loader API versions roller can talk to.
+var supportedAPIVersions = []int{1}
+
+var openPlugins = make(map[string]*Plugin)
+
+type transport interface {
+	call(ctx context.Context, method string, params interface{}, result interface{}) error
+	// usable is false once the plugin can not answer any more calls
+	usable() bool
+	close() error
+}
+
+// Plugin is a loader from the plugin_dir. Out-of-process plugins speak the
+// protocol in pkg over their stdin/stdout, Go plugins are adapted to it so
+// roller treats both the same way.
+type Plugin struct {
+	Path         string
+	Kind         string
+	APIVersion   int
+	Capabilities []string
+	transport    transport
+}
+
+// OpenPlugin starts the named plugin or returns it if it is already running.
+func OpenPlugin(name string) (*Plugin, error) {
+	modulePath := path.Join(viper.GetString("plugin_dir"), name)
+	if p, ok := openPlugins[modulePath]; ok {
+		return p, nil
+	}
+
+	p := &Plugin{Path: modulePath}
+	var err error
+	if isGoPlugin(modulePath) {
+		p.Kind = "go-plugin"
+		p.transport, err = openGoPlugin(modulePath)
+	} else {
+		p.Kind = "process"
+		p.transport, err = startProcess(modulePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("loader_timeout"))
+	defer cancel()
+
+	var handshake pkg.HandshakeResponse
+	err = p.transport.call(ctx, pkg.MethodHandshake, pkg.HandshakeRequest{APIVersions: supportedAPIVersions}, &handshake)
+	if err != nil {
+		p.transport.close()
+		return nil, fmt.Errorf("%s: handshake failed: %s", modulePath, err)
+	}
+
+	supported := false
+	for _, v := range supportedAPIVersions {
+		supported = supported || v == handshake.APIVersion
+	}
+	if !supported {
+		p.transport.close()
+		return nil, fmt.Errorf("%s uses API version %d, which this version of roller does not support", modulePath, handshake.APIVersion)
+	}
+
+	p.APIVersion = handshake.APIVersion
+	p.Capabilities = handshake.Capabilities
+	openPlugins[modulePath] = p
+
+	return p, nil
+}
+
+// ClosePlugins shuts down every plugin started by this process.
+func ClosePlugins() {
+	for k, p := range openPlugins {
+		p.transport.close()
+		delete(openPlugins, k)
+	}
+}
+
+func (p *Plugin) Has(capability string) bool {
+	for _, c := range p.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Plugin) LoadContext(ctx context.Context, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	var results []pkg.LoadedProfile
+	err := p.call(ctx, pkg.MethodLoad, loadRequest(config, nil), &results)
+
+	return results, err
+}
+
+func (p *Plugin) Refresh(ctx context.Context, config *pkg.LoaderConfig, previous []pkg.LoadedProfile) ([]pkg.LoadedProfile, error) {
+	var results []pkg.LoadedProfile
+	err := p.call(ctx, pkg.MethodRefresh, loadRequest(config, previous), &results)
+
+	return results, err
+}
+
+func (p *Plugin) Describe(ctx context.Context) ([]pkg.OptionDescription, error) {
+	var resp pkg.DescribeResponse
+	err := p.call(ctx, pkg.MethodDescribe, struct{}{}, &resp)
+
+	return resp.Options, err
+}
+
+func (p *Plugin) Validate(ctx context.Context, config *pkg.LoaderConfig) ([]string, error) {
+	var resp pkg.ValidateResponse
+	err := p.call(ctx, pkg.MethodValidate, loadRequest(config, nil), &resp)
+
+	return resp.Errors, err
+}
+
+// call calls the plugin, forgetting it when it can not be used any more, so
+// it is started again the next time it is needed.
+func (p *Plugin) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	err := p.transport.call(ctx, method, params, result)
+	if !p.transport.usable() && openPlugins[p.Path] == p {
+		delete(openPlugins, p.Path)
+	}
+
+	return err
+}
+
+func loadRequest(config *pkg.LoaderConfig, previous []pkg.LoadedProfile) pkg.LoadRequest {
+	return pkg.LoadRequest{
+		Name:     config.GetName(),
+		Options:  config.GetOptions(),
+		TTL:      config.GetTtl(),
+		Previous: previous,
+	}
+}
+
+// isGoPlugin tells Go plugins, which are shared objects, apart from
+// executables speaking the plugin protocol.
+func isGoPlugin(modulePath string) bool {
+	if f, err := elf.Open(modulePath); err == nil {
+		defer f.Close()
+		if f.Type != elf.ET_DYN {
+			return false
+		}
+		// position independent executables are ET_DYN too, but have an interpreter
+		for _, prog := range f.Progs {
+			if prog.Type == elf.PT_INTERP {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if f, err := macho.Open(modulePath); err == nil {
+		defer f.Close()
+
+		return f.Type == macho.TypeDylib || f.Type == macho.TypeBundle
+	}
+
+	return false
+}
+
+// goPluginTransport is the adapter for Go plugins, answering the protocol
+// in process.
+type goPluginTransport struct {
+	handler *pkg.Handler
+}
+
+func openGoPlugin(modulePath string) (transport, error) {
+	plug, err := plugin.Open(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	symLoader, err := plug.Lookup("Loader")
+	if err != nil {
+		return nil, err
+	}
+
+	// Assert that one of the interfaces is implemented
+	_, v1 := symLoader.(pkg.Loader)
+	_, v2 := symLoader.(pkg.LoaderV2)
+	if !v1 && !v2 {
+		return nil, fmt.Errorf("%s is either outdated or invalid! Make sure it implements the proper interface", modulePath)
+	}
+
+	handler := pkg.NewHandler(symLoader)
+	// plugins built before the API was versioned are version 1
+	handler.APIVersion = 1
+	if symVersion, err := plug.Lookup("APIVersion"); err == nil {
+		if v, ok := symVersion.(*int); ok {
+			handler.APIVersion = *v
+		}
+	}
+
+	return &goPluginTransport{handler}, nil
+}
+
+// call passes ctx on to the plugin, and returns when it is done even if the
+// plugin does not stop, as it can not be killed.
+func (t *goPluginTransport) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	type response struct {
+		result interface{}
+		err    *pkg.RPCError
+	}
+	done := make(chan response, 1)
+	go func() {
+		res, rpcErr := t.handler.Handle(ctx, method, encoded)
+		done <- response{res, rpcErr}
+	}()
+
+	var res response
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %s", method, ctx.Err())
+	}
+	if res.err != nil {
+		return res.err
+	}
+	if result == nil {
+		return nil
+	}
+
+	encoded, err = json.Marshal(res.result)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(encoded, result)
+}
+
+func (t *goPluginTransport) usable() bool {
+	return true
+}
+
+func (t *goPluginTransport) close() error {
+	return nil
+}
+
+type processTransport struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	nextID int
+	// exited is set by roundTrip, dead by call once the process was killed
+	// or exited
+	exited bool
+	dead   bool
+}
+
+func startProcess(modulePath string) (transport, error) {
+	cmd := exec.Command(modulePath)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	return &processTransport{cmd: cmd, stdin: stdin, stdout: scanner}, nil
+}
+
+// call sends a request and waits for its response. If ctx is done first the
+// plugin is killed, as the stream can not be resynchronised afterwards.
+func (t *processTransport) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- t.roundTrip(method, params, result)
+	}()
+
+	select {
+	case err := <-done:
+		t.dead = t.exited
+		return err
+	case <-ctx.Done():
+		t.cmd.Process.Kill()
+		t.dead = true
+		return fmt.Errorf("%s: %s", method, ctx.Err())
+	}
+}
+
+func (t *processTransport) usable() bool {
+	return !t.dead
+}
+
+func (t *processTransport) roundTrip(method string, params interface{}, result interface{}) error {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	t.nextID++
+	req, err := json.Marshal(pkg.RPCRequest{JSONRPC: "2.0", ID: t.nextID, Method: method, Params: encoded})
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.stdin.Write(append(req, '\n')); err != nil {
+		return err
+	}
+
+	if !t.stdout.Scan() {
+		if err := t.stdout.Err(); err != nil {
+			t.exited = true
+			return err
+		}
+		t.exited = true
+		return fmt.Errorf("the plugin exited while handling %s", method)
+	}
+
+	var resp pkg.RPCResponse
+	if err := json.Unmarshal(t.stdout.Bytes(), &resp); err != nil {
+		return err
+	}
+	if resp.ID != t.nextID {
+		return fmt.Errorf("unexpected response id %d for %s", resp.ID, method)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Result, result)
+}
+
+func (t *processTransport) close() error {
+	if t.dead {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.call(ctx, pkg.MethodShutdown, struct{}{}, nil)
+	t.stdin.Close()
+
+	return t.cmd.Wait()
+}
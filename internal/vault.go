@@ -0,0 +1,158 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mitom/roller/pkg"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// vaultMagic starts every vault file, followed by the scrypt salt, the
+// nonce and the sealed contents.
+var vaultMagic = []byte("roller-vault-1\n")
+
+const vaultExtension = ".vault"
+
+// vaultPassphrase is kept once given, so it is only asked for once.
+var vaultPassphrase []byte
+
+// VaultBackend tells whether the sessions are kept in encrypted files
+// instead of plaintext ones (credentials_backend: vault).
+func VaultBackend() bool {
+	return viper.GetString("credentials_backend") == "vault"
+}
+
+func isVault(path string) bool {
+	return strings.HasSuffix(path, vaultExtension)
+}
+
+// passphrase returns the passphrase of the vault from ROLLER_VAULT_PASSPHRASE,
+// the vault_key_file or by asking for it.
+func passphrase(confirm bool) ([]byte, error) {
+	if vaultPassphrase != nil {
+		return vaultPassphrase, nil
+	}
+
+	if p := viper.GetString("vault_passphrase"); p != "" {
+		vaultPassphrase = []byte(p)
+	} else if keyFile := viper.GetString("vault_key_file"); keyFile != "" {
+		path, err := pkg.ExpandPath(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		vaultPassphrase = bytes.TrimSpace(key)
+	} else {
+		p := PromptSecret("Enter the passphrase of the roller vault: ")
+		if confirm && PromptSecret("Enter it again: ") != p {
+			return nil, errors.New("the passphrases do not match")
+		}
+		vaultPassphrase = []byte(p)
+	}
+
+	if len(vaultPassphrase) == 0 {
+		vaultPassphrase = nil
+		return nil, errors.New("the passphrase of the vault can not be empty")
+	}
+
+	return vaultPassphrase, nil
+}
+
+func vaultKey(passphrase []byte, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	copy(key[:], derived)
+
+	return &key, nil
+}
+
+// sealVault encrypts the contents of a vault file.
+func sealVault(plain []byte) ([]byte, error) {
+	p, err := passphrase(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var salt [16]byte
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, salt[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	key, err := vaultKey(p, salt[:])
+	if err != nil {
+		return nil, err
+	}
+
+	out := append(append(append([]byte{}, vaultMagic...), salt[:]...), nonce[:]...)
+
+	return secretbox.Seal(out, plain, &nonce, key), nil
+}
+
+// openVault decrypts the contents of a vault file.
+func openVault(sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, vaultMagic) || len(sealed) < len(vaultMagic)+16+24 {
+		return nil, errors.New("not a roller vault")
+	}
+	sealed = sealed[len(vaultMagic):]
+
+	p, err := passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := vaultKey(p, sealed[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[16:40])
+	plain, ok := secretbox.Open(nil, sealed[40:], &nonce, key)
+	if !ok {
+		// let the next attempt ask again
+		vaultPassphrase = nil
+		return nil, fmt.Errorf("can not open the vault, the passphrase is wrong or it is damaged")
+	}
+
+	return plain, nil
+}
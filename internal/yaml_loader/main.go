@@ -0,0 +1,98 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package yaml_loader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/mitom/roller/internal/json_loader"
+	"github.com/mitom/roller/pkg"
+
+	"gopkg.in/yaml.v2"
+)
+
+type loader string
+
+var Loader loader
+
+func (l loader) LoadContext(ctx context.Context, config *pkg.LoaderConfig) ([]pkg.LoadedProfile, error) {
+	path, ok := config.GetOptions()["path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing the `path` attribute")
+	}
+
+	path, err := pkg.ExpandPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc document
+	if err := yaml.Unmarshal(read, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return json_loader.Extract(doc.value, config)
+}
+
+// document is a YAML value in the map[string]interface{} shape the JSON
+// loader works with. Scalars are kept as they were written, so an account ID
+// like 012345678901 is not read as a number, losing its leading zero.
+type document struct {
+	value interface{}
+}
+
+func (d *document) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var m map[string]document
+	if err := unmarshal(&m); err == nil {
+		values := make(map[string]interface{}, len(m))
+		for k, e := range m {
+			values[k] = e.value
+		}
+		d.value = values
+		return nil
+	}
+
+	var s []document
+	if err := unmarshal(&s); err == nil {
+		values := make([]interface{}, len(s))
+		for i, e := range s {
+			values[i] = e.value
+		}
+		d.value = values
+		return nil
+	}
+
+	// yaml.v2 gives the text of any scalar to a string
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	d.value = text
+
+	return nil
+}
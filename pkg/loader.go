@@ -20,24 +20,133 @@
 
 package pkg
 
+import (
+	"context"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
 type Loader interface {
 	Load(config *LoaderConfig) []LoadedProfile
 }
 
+// LoaderV2 is a Loader which can be cancelled and report failures. Roller
+// prefers it when a loader implements both interfaces.
+type LoaderV2 interface {
+	LoadContext(ctx context.Context, config *LoaderConfig) ([]LoadedProfile, error)
+}
+
+// CacheValidators identify the version of a source a loader last read, in
+// the form of the HTTP ETag and Last-Modified headers.
+type CacheValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// ConditionalLoader is implemented by loaders which can tell whether their
+// source changed since the validators were recorded. When it did not, modified
+// is false and roller keeps using the profiles it cached before.
+type ConditionalLoader interface {
+	LoadConditional(ctx context.Context, config *LoaderConfig, validators CacheValidators) (profiles []LoadedProfile, updated CacheValidators, modified bool, err error)
+}
+
 type SwitchRoleParameters struct {
 	FromProfile string
 	AccountID   string
 	Role        string
 	TTL         string
+	// Via are the roles to assume in order, starting from FromProfile, to
+	// reach the role when it can not be assumed directly.
+	Via []RoleHop `json:",omitempty"`
+	// ExternalID is required by the trust policy of some roles, most often
+	// the ones in accounts managed by third parties.
+	ExternalID string `json:",omitempty"`
+	// PolicyFile is the path of a session policy and PolicyArns are managed
+	// policies, both limiting what the session is allowed to do.
+	PolicyFile string   `json:",omitempty"`
+	PolicyArns []string `json:",omitempty"`
+}
+
+// RoleHop is a role assumed on the way to another one.
+type RoleHop struct {
+	AccountID  string
+	Role       string
+	ExternalID string `json:",omitempty"`
+}
+
+func (h RoleHop) String() string {
+	if h.ExternalID != "" {
+		return h.AccountID + "/" + h.Role + ":" + h.ExternalID
+	}
+
+	return h.AccountID + "/" + h.Role
+}
+
+// ParseRoleHops parses the textual form of a role chain, which is a list of
+// `<account id>/<role>[:<external id>]` separated by `>`, e.g.
+// `111111111111/Hub > 222222222222/Audit:vendor-id`.
+func ParseRoleHops(value string) ([]RoleHop, error) {
+	var hops []RoleHop
+	if strings.TrimSpace(value) == "" {
+		return hops, nil
+	}
+
+	for _, part := range strings.Split(value, ">") {
+		part = strings.TrimSpace(part)
+		var hop RoleHop
+		// role names can not contain a colon, external IDs can
+		if i := strings.Index(part, ":"); i >= 0 {
+			hop.ExternalID = part[i+1:]
+			part = part[:i]
+		}
+		i := strings.Index(part, "/")
+		if i <= 0 || i == len(part)-1 {
+			return nil, fmt.Errorf("invalid role hop %q, expected <account id>/<role>[:<external id>]", part)
+		}
+		hop.AccountID, hop.Role = part[:i], part[i+1:]
+		hops = append(hops, hop)
+	}
+
+	return hops, nil
+}
+
+// FormatRoleHops is the reverse of ParseRoleHops.
+func FormatRoleHops(hops []RoleHop) string {
+	parts := make([]string, len(hops))
+	for i, hop := range hops {
+		parts[i] = hop.String()
+	}
+
+	return strings.Join(parts, " > ")
 }
 
 func (p SwitchRoleParameters) Valid() bool {
 	return true
 }
 
+// LoadedProfile is a role provided by a loader. Besides what is needed to
+// switch to it, it can carry metadata about the account, where Tags is open
+// for anything the well-known fields do not cover.
 type LoadedProfile struct {
-	Name       string
-	Parameters SwitchRoleParameters
+	Name        string
+	Parameters  SwitchRoleParameters
+	Description string            `json:",omitempty"`
+	Region      string            `json:",omitempty"`
+	Owner       string            `json:",omitempty"`
+	Tags        map[string]string `json:",omitempty"`
+	// Source is the name of the loader config the profile came from, it is
+	// set by roller.
+	Source string `json:",omitempty"`
+}
+
+// SetTag sets a tag, creating the map if needed.
+func (p *LoadedProfile) SetTag(key string, value string) {
+	if p.Tags == nil {
+		p.Tags = make(map[string]string)
+	}
+	p.Tags[key] = value
 }
 
 type LoaderConfig struct {
@@ -73,3 +182,17 @@ func NewLoaderConfig(name string, loader string, options map[string]interface{},
 
 	return &c
 }
+
+// ExpandPath resolves a leading ~/ to the current user's home directory and
+// makes the result absolute, so loaders can accept paths as written in the config.
+func ExpandPath(path string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		usr, err := user.Current()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(usr.HomeDir, path[2:])
+	}
+
+	return filepath.Abs(path)
+}
@@ -0,0 +1,288 @@
+// Copyright © 2018 Tamas Millian <tamas.millian@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// APIVersion is the version of the loader API described by this package.
+// Plugins report the version they were built against in the handshake, so
+// new methods can be added without breaking plugins written for older ones.
+const APIVersion = 1
+
+// Capabilities a plugin can declare in the handshake.
+const (
+	CapabilityLoad     = "load"
+	CapabilityRefresh  = "refresh"
+	CapabilityDescribe = "describe"
+	CapabilityValidate = "validate"
+)
+
+// Methods of the plugin protocol.
+const (
+	MethodHandshake = "handshake"
+	MethodLoad      = "load"
+	MethodRefresh   = "refresh"
+	MethodDescribe  = "describe"
+	MethodValidate  = "validate"
+	MethodShutdown  = "shutdown"
+)
+
+// JSON-RPC error codes used by the plugin protocol.
+const (
+	ErrorParse          = -32700
+	ErrorMethodNotFound = -32601
+	ErrorInvalidParams  = -32602
+	ErrorInternal       = -32603
+	ErrorUnsupported    = -32000
+	ErrorLoad           = -32001
+)
+
+// Refresher is implemented by loaders which can update a previously loaded
+// set of profiles cheaper than loading them from scratch.
+type Refresher interface {
+	Refresh(config *LoaderConfig, previous []LoadedProfile) []LoadedProfile
+}
+
+// Describer is implemented by loaders which document their options.
+type Describer interface {
+	Describe() []OptionDescription
+}
+
+// Validator is implemented by loaders which can check their config before
+// anything is loaded.
+type Validator interface {
+	Validate(config *LoaderConfig) []string
+}
+
+type OptionDescription struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+type HandshakeRequest struct {
+	APIVersions []int `json:"api_versions"`
+}
+
+type HandshakeResponse struct {
+	APIVersion   int      `json:"api_version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type LoadRequest struct {
+	Name     string                 `json:"name"`
+	Options  map[string]interface{} `json:"options"`
+	TTL      int                    `json:"ttl"`
+	Previous []LoadedProfile        `json:"previous,omitempty"`
+}
+
+func (r LoadRequest) config() *LoaderConfig {
+	return NewLoaderConfig(r.Name, "", r.Options, r.TTL)
+}
+
+type DescribeResponse struct {
+	Options []OptionDescription `json:"options"`
+}
+
+type ValidateResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// RPCRequest and RPCResponse are JSON-RPC 2.0 messages, sent one per line.
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      int             `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      int             `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// Handler answers plugin protocol calls with a Loader or a LoaderV2. The
+// capabilities are derived from the optional interfaces the loader implements.
+type Handler struct {
+	Loader     interface{}
+	APIVersion int
+}
+
+func NewHandler(loader interface{}) *Handler {
+	return &Handler{Loader: loader, APIVersion: APIVersion}
+}
+
+func (h *Handler) Capabilities() []string {
+	var capabilities []string
+	_, v1 := h.Loader.(Loader)
+	_, v2 := h.Loader.(LoaderV2)
+	if v1 || v2 {
+		capabilities = append(capabilities, CapabilityLoad)
+	}
+	if _, ok := h.Loader.(Refresher); ok {
+		capabilities = append(capabilities, CapabilityRefresh)
+	}
+	if _, ok := h.Loader.(Describer); ok {
+		capabilities = append(capabilities, CapabilityDescribe)
+	}
+	if _, ok := h.Loader.(Validator); ok {
+		capabilities = append(capabilities, CapabilityValidate)
+	}
+
+	return capabilities
+}
+
+// Handle answers a call. ctx is passed on to a LoaderV2, so it can stop when
+// roller does not wait for it any more.
+func (h *Handler) Handle(ctx context.Context, method string, params json.RawMessage) (interface{}, *RPCError) {
+	switch method {
+	case MethodHandshake:
+		var req HandshakeRequest
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, &RPCError{ErrorInvalidParams, err.Error()}
+		}
+
+		// pick the newest version both sides understand
+		version := 0
+		for _, v := range req.APIVersions {
+			if v <= h.APIVersion && v > version {
+				version = v
+			}
+		}
+		if version == 0 {
+			return nil, &RPCError{ErrorUnsupported, fmt.Sprintf("none of the API versions %v are supported", req.APIVersions)}
+		}
+
+		return HandshakeResponse{version, h.Capabilities()}, nil
+	case MethodLoad:
+		var req LoadRequest
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, &RPCError{ErrorInvalidParams, err.Error()}
+		}
+
+		switch loader := h.Loader.(type) {
+		case LoaderV2:
+			profiles, err := loader.LoadContext(ctx, req.config())
+			if err != nil {
+				return nil, &RPCError{ErrorLoad, err.Error()}
+			}
+
+			return profiles, nil
+		case Loader:
+			return loader.Load(req.config()), nil
+		default:
+			return nil, &RPCError{ErrorUnsupported, "load is not supported"}
+		}
+	case MethodRefresh:
+		refresher, ok := h.Loader.(Refresher)
+		if !ok {
+			return nil, &RPCError{ErrorUnsupported, "refresh is not supported"}
+		}
+		var req LoadRequest
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, &RPCError{ErrorInvalidParams, err.Error()}
+		}
+
+		return refresher.Refresh(req.config(), req.Previous), nil
+	case MethodDescribe:
+		describer, ok := h.Loader.(Describer)
+		if !ok {
+			return nil, &RPCError{ErrorUnsupported, "describe is not supported"}
+		}
+
+		return DescribeResponse{describer.Describe()}, nil
+	case MethodValidate:
+		validator, ok := h.Loader.(Validator)
+		if !ok {
+			return nil, &RPCError{ErrorUnsupported, "validate is not supported"}
+		}
+		var req LoadRequest
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, &RPCError{ErrorInvalidParams, err.Error()}
+		}
+
+		return ValidateResponse{validator.Validate(req.config())}, nil
+	case MethodShutdown:
+		return nil, nil
+	default:
+		return nil, &RPCError{ErrorMethodNotFound, fmt.Sprintf("unknown method %s", method)}
+	}
+}
+
+// Serve runs loader, a Loader or a LoaderV2, as an out-of-process plugin,
+// answering requests on stdin until roller asks it to shut down or closes
+// the pipe.
+func Serve(loader interface{}) error {
+	return NewHandler(loader).Serve(os.Stdin, os.Stdout)
+}
+
+func (h *Handler) Serve(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	encoder := json.NewEncoder(out)
+
+	for scanner.Scan() {
+		var req RPCRequest
+		resp := RPCResponse{JSONRPC: "2.0"}
+
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = &RPCError{ErrorParse, err.Error()}
+		} else {
+			resp.ID = req.ID
+			// roller kills the process when it does not wait any more
+			result, rpcErr := h.Handle(context.Background(), req.Method, req.Params)
+			if rpcErr != nil {
+				resp.Error = rpcErr
+			} else if resp.Result, err = json.Marshal(result); err != nil {
+				resp.Error = &RPCError{ErrorInternal, err.Error()}
+			}
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+
+		if req.Method == MethodShutdown {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}